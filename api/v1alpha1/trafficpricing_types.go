@@ -0,0 +1,91 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TrafficPricingSpec defines how the traffic of the tags is priced. The free allowances
+// and the tiers apply to the traffic of a namespace within a calendar month (UTC).
+type TrafficPricingSpec struct {
+	// the currency of the prices as an ISO 4217 code, e.g. CNY
+	//+kubebuilder:validation:Pattern=`^[A-Z]{3}$`
+	Currency string `json:"currency"`
+	// the rule of a tag and direction is used if there is one, then the rule of the
+	// direction with the tag "*"; the traffic matched by no rule is free
+	Rules []PricingRule `json:"rules,omitempty"`
+}
+
+type PricingRule struct {
+	// a tag like world or a port number, or * for all tags
+	Tag string `json:"tag"`
+	//+kubebuilder:validation:Enum=sent;recv
+	//+kubebuilder:default=sent
+	Direction string `json:"direction,omitempty"`
+	// the traffic free of charge every month
+	FreeGiB *resource.Quantity `json:"freeGiB,omitempty"`
+	// the prices of the traffic beyond the free allowance, ordered by upToGiB. The last
+	// tier may leave upToGiB empty to apply to all remaining traffic; the traffic beyond
+	// the last tier is free otherwise
+	//+kubebuilder:validation:MinItems=1
+	Tiers []PricingTier `json:"tiers"`
+}
+
+type PricingTier struct {
+	// the monthly traffic, including the free allowance, up to which this tier applies
+	UpToGiB *resource.Quantity `json:"upToGiB,omitempty"`
+	// the price of a GiB within this tier
+	PricePerGiB resource.Quantity `json:"pricePerGiB"`
+}
+
+// TrafficPricingStatus defines the observed state of TrafficPricing
+type TrafficPricingStatus struct {
+	// the generation of the spec the synchronizer prices the traffic with
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// why the spec can't be applied; the previous one stays in effect
+	Error string `json:"error,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Currency",type=string,JSONPath=`.spec.currency`
+//+kubebuilder:printcolumn:name="Observed",type=integer,JSONPath=`.status.observedGeneration`
+
+// TrafficPricing is the Schema for the trafficpricings API
+type TrafficPricing struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TrafficPricingSpec   `json:"spec,omitempty"`
+	Status TrafficPricingStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// TrafficPricingList contains a list of TrafficPricing
+type TrafficPricingList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TrafficPricing `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TrafficPricing{}, &TrafficPricingList{})
+}
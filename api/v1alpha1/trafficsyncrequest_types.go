@@ -17,7 +17,33 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"time"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	TAG_DIRECTION_SENT = "sent"
+	TAG_DIRECTION_RECV = "recv"
+	TAG_DIRECTION_BOTH = "both"
+
+	// account the growth of the counters of the agent since the last sync
+	ACCOUNTING_MODE_DELTA = "Delta"
+	// read and reset the counters of the agent, accounting them as a whole
+	ACCOUNTING_MODE_RESET = "Reset"
+
+	// set to "true" on a deleted request to release it at once when its final sync fails,
+	// instead of retrying it for the grace period of the deletion policy
+	FORCE_RELEASE_ANNOTATION = "networking.sealos.io/force-release"
+
+	// the addresses and the node IP are taken from the spec
+	ADDRESS_SOURCE_SPEC = "Spec"
+	// the addresses and the node IP are taken from the CiliumEndpoint of the pod
+	ADDRESS_SOURCE_CILIUM_ENDPOINT = "CiliumEndpoint"
+
+	// whether the spec agrees with the CiliumEndpoint of the pod
+	CONDITION_ENDPOINT_MATCHED = "EndpointMatched"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -36,6 +62,89 @@ type TrafficSyncRequestSpec struct {
 	Address             string          `json:"address,omitempty"`
 	Tags                []string        `json:"tags,omitempty"`
 	SyncPeriod          metav1.Duration `json:"syncPeriod,omitempty"`
+	// the tags synchronized with their own options; a tag listed in both tags and
+	// tagSpecs is synchronized with the options given here
+	TagSpecs []TagSpec `json:"tagSpecs,omitempty"`
+	// more addresses of the pod, e.g. the IPv6 one of a dual-stack pod; every tag is
+	// synchronized for address and each of them
+	Addresses []string `json:"addresses,omitempty"`
+	// where the addresses and the node IP come from. With CiliumEndpoint, they are taken
+	// from the CiliumEndpoint with ciliumEndpointID on the node, or of the pod if the ID
+	// is 0, and kept up to date as the endpoint changes; the spec is used until it's found.
+	// The requests are still sharded and, in the node mode, selected by spec.nodeIP, so it
+	// has to be set with sharding or the node mode as well
+	//+kubebuilder:validation:Enum=Spec;CiliumEndpoint
+	//+kubebuilder:default=Spec
+	AddressSource string `json:"addressSource,omitempty"`
+}
+
+// TagSpec is a tag synchronized with its own options.
+type TagSpec struct {
+	Name string `json:"name"`
+	// how often the tag is synchronized; spec.syncPeriod if empty
+	SyncPeriod *metav1.Duration `json:"syncPeriod,omitempty"`
+	// the direction of the traffic accounted
+	//+kubebuilder:validation:Enum=sent;recv;both
+	//+kubebuilder:default=sent
+	Direction string `json:"direction,omitempty"`
+	// Delta accounts the growth of the counters of the agent since the last sync; Reset
+	// reads and resets the counters, so the traffic since the last read is lost if the
+	// sync fails after reading them
+	//+kubebuilder:validation:Enum=Delta;Reset
+	//+kubebuilder:default=Delta
+	AccountingMode string `json:"accountingMode,omitempty"`
+}
+
+// EffectiveTags returns the tags to synchronize with their options filled in.
+func (s *TrafficSyncRequestSpec) EffectiveTags() []TagSpec {
+	var tags []TagSpec
+	index := make(map[string]int)
+	add := func(t TagSpec) {
+		if t.SyncPeriod == nil {
+			t.SyncPeriod = &s.SyncPeriod
+		}
+		if t.Direction == "" {
+			t.Direction = TAG_DIRECTION_SENT
+		}
+		if t.AccountingMode == "" {
+			t.AccountingMode = ACCOUNTING_MODE_DELTA
+		}
+		if i, ok := index[t.Name]; ok {
+			tags[i] = t
+			return
+		}
+		index[t.Name] = len(tags)
+		tags = append(tags, t)
+	}
+	for _, name := range s.Tags {
+		add(TagSpec{Name: name})
+	}
+	for _, t := range s.TagSpecs {
+		add(t)
+	}
+	return tags
+}
+
+// EffectiveAddresses returns address and addresses without duplicates.
+func (s *TrafficSyncRequestSpec) EffectiveAddresses() []string {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range append([]string{s.Address}, s.Addresses...) {
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// Period returns how often the tag is synchronized.
+func (t *TagSpec) Period() time.Duration {
+	if t.SyncPeriod == nil {
+		return 0
+	}
+	return t.SyncPeriod.Duration
 }
 
 // TrafficSyncRequestStatus defines the observed state of TrafficSyncRequest
@@ -43,10 +152,49 @@ type TrafficSyncRequestStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 	LastSyncTime map[string]metav1.Time `json:"lastSyncTime,omitempty"`
+	// the progress of every tag; a failing tag is retried with backoff while the other tags
+	// stay on schedule
+	Tags map[string]TagSyncStatus `json:"tags,omitempty"`
+	// the progress of the tags of every address, keyed by the normalized address
+	Addresses map[string]AddressSyncStatus `json:"addresses,omitempty"`
+	// when the tags were synchronized the last time after the pod was deleted; the request
+	// isn't synchronized any more and can be deleted
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// the actual state of the CiliumEndpoint of the pod
+	Endpoint *EndpointStatus `json:"endpoint,omitempty"`
+	// the uid of the pod when it was seen the first time; a pod of the same name with
+	// another uid has replaced it, so the pod of the request is gone
+	PodUID types.UID `json:"podUID,omitempty"`
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+type EndpointStatus struct {
+	// the name of the CiliumEndpoint in the namespace of the pod
+	Name      string   `json:"name"`
+	ID        int64    `json:"id,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	NodeIP    string   `json:"nodeIP,omitempty"`
+}
+
+type AddressSyncStatus struct {
+	Tags map[string]TagSyncStatus `json:"tags,omitempty"`
+}
+
+type TagSyncStatus struct {
+	LastAttemptTime metav1.Time `json:"lastAttemptTime,omitempty"`
+	// the error of the last attempt; empty if it succeeded
+	LastError string `json:"lastError,omitempty"`
+	// the number of attempts failed in a row
+	ConsecutiveFailures int32 `json:"consecutiveFailures,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Pod",type=string,JSONPath=`.spec.associatedPod`
+//+kubebuilder:printcolumn:name="Completed",type=date,JSONPath=`.status.completionTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // TrafficSyncRequest is the Schema for the trafficsyncrequests API
 type TrafficSyncRequest struct {
@@ -26,6 +26,48 @@ import (
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AddressSyncStatus) DeepCopyInto(out *AddressSyncStatus) {
+	*out = *in
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make(map[string]TagSyncStatus, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AddressSyncStatus.
+func (in *AddressSyncStatus) DeepCopy() *AddressSyncStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AddressSyncStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EndpointStatus) DeepCopyInto(out *EndpointStatus) {
+	*out = *in
+	if in.Addresses != nil {
+		in, out := &in.Addresses, &out.Addresses
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EndpointStatus.
+func (in *EndpointStatus) DeepCopy() *EndpointStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(EndpointStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PortFeedRequest) DeepCopyInto(out *PortFeedRequest) {
 	*out = *in
@@ -117,6 +159,186 @@ func (in *PortFeedRequestStatus) DeepCopy() *PortFeedRequestStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PricingRule) DeepCopyInto(out *PricingRule) {
+	*out = *in
+	if in.FreeGiB != nil {
+		in, out := &in.FreeGiB, &out.FreeGiB
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.Tiers != nil {
+		in, out := &in.Tiers, &out.Tiers
+		*out = make([]PricingTier, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PricingRule.
+func (in *PricingRule) DeepCopy() *PricingRule {
+	if in == nil {
+		return nil
+	}
+	out := new(PricingRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PricingTier) DeepCopyInto(out *PricingTier) {
+	*out = *in
+	if in.UpToGiB != nil {
+		in, out := &in.UpToGiB, &out.UpToGiB
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	out.PricePerGiB = in.PricePerGiB.DeepCopy()
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PricingTier.
+func (in *PricingTier) DeepCopy() *PricingTier {
+	if in == nil {
+		return nil
+	}
+	out := new(PricingTier)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TagSpec) DeepCopyInto(out *TagSpec) {
+	*out = *in
+	if in.SyncPeriod != nil {
+		in, out := &in.SyncPeriod, &out.SyncPeriod
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TagSpec.
+func (in *TagSpec) DeepCopy() *TagSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(TagSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TagSyncStatus) DeepCopyInto(out *TagSyncStatus) {
+	*out = *in
+	in.LastAttemptTime.DeepCopyInto(&out.LastAttemptTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TagSyncStatus.
+func (in *TagSyncStatus) DeepCopy() *TagSyncStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(TagSyncStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TrafficPricing) DeepCopyInto(out *TrafficPricing) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	out.Status = in.Status
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TrafficPricing.
+func (in *TrafficPricing) DeepCopy() *TrafficPricing {
+	if in == nil {
+		return nil
+	}
+	out := new(TrafficPricing)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *TrafficPricing) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TrafficPricingList) DeepCopyInto(out *TrafficPricingList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]TrafficPricing, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TrafficPricingList.
+func (in *TrafficPricingList) DeepCopy() *TrafficPricingList {
+	if in == nil {
+		return nil
+	}
+	out := new(TrafficPricingList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *TrafficPricingList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TrafficPricingSpec) DeepCopyInto(out *TrafficPricingSpec) {
+	*out = *in
+	if in.Rules != nil {
+		in, out := &in.Rules, &out.Rules
+		*out = make([]PricingRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TrafficPricingSpec.
+func (in *TrafficPricingSpec) DeepCopy() *TrafficPricingSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(TrafficPricingSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TrafficPricingStatus) DeepCopyInto(out *TrafficPricingStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TrafficPricingStatus.
+func (in *TrafficPricingStatus) DeepCopy() *TrafficPricingStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(TrafficPricingStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TrafficSyncRequest) DeepCopyInto(out *TrafficSyncRequest) {
 	*out = *in
@@ -185,6 +407,18 @@ func (in *TrafficSyncRequestSpec) DeepCopyInto(out *TrafficSyncRequestSpec) {
 		copy(*out, *in)
 	}
 	out.SyncPeriod = in.SyncPeriod
+	if in.TagSpecs != nil {
+		in, out := &in.TagSpecs, &out.TagSpecs
+		*out = make([]TagSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Addresses != nil {
+		in, out := &in.Addresses, &out.Addresses
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TrafficSyncRequestSpec.
@@ -207,6 +441,36 @@ func (in *TrafficSyncRequestStatus) DeepCopyInto(out *TrafficSyncRequestStatus)
 			(*out)[key] = *val.DeepCopy()
 		}
 	}
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make(map[string]TagSyncStatus, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.Addresses != nil {
+		in, out := &in.Addresses, &out.Addresses
+		*out = make(map[string]AddressSyncStatus, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Endpoint != nil {
+		in, out := &in.Endpoint, &out.Endpoint
+		*out = new(EndpointStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TrafficSyncRequestStatus.
@@ -0,0 +1,244 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	nmv1alpha1 "github.com/dinoallo/sealos-networkmanager-synchronizer/api/v1alpha1"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/store"
+)
+
+const (
+	// the mark of the port feed is ahead of the total of the pod traffic account, so
+	// the port feed will never be synchronized again until the mark is repaired
+	KIND_STALE_MARK = "StaleMark"
+	// the mark of the port feed is behind the total of the pod traffic account although
+	// the port feed request should have been synchronized by now
+	KIND_LAGGING = "Lagging"
+	// the port feed has accounted more bytes than the pod traffic account has
+	KIND_OVERCOUNTED = "Overcounted"
+	// the port feed has an address which the pod traffic account doesn't know about
+	KIND_ORPHANED = "Orphaned"
+)
+
+var (
+	discrepancies = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sealos_nm_syncer_port_feed_discrepancies",
+		Help: "Number of discrepancies between port feeds and pod traffic accounts found by the last check",
+	}, []string{"kind"})
+	repairs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sealos_nm_syncer_port_feed_repairs_total",
+		Help: "Total number of port feed discrepancies repaired",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(discrepancies, repairs)
+}
+
+// Discrepancy describes a tag of an address whose port feed has drifted from the pod traffic account.
+type Discrepancy struct {
+	PortFeedRequest types.NamespacedName
+	PortFeed        string
+	Address         string
+	Tag             string
+	Kind            string
+	PortFeedMark    uint64
+	PortFeedBytes   uint64
+	AccountBytes    uint64
+}
+
+func (d Discrepancy) String() string {
+	return fmt.Sprintf("%s: port feed %s, address %s, tag %s (port feed mark %d, port feed bytes %d, account bytes %d)",
+		d.Kind, d.PortFeed, d.Address, d.Tag, d.PortFeedMark, d.PortFeedBytes, d.AccountBytes)
+}
+
+// Checker compares every port feed with the pod traffic account it is fed from.
+type Checker struct {
+	Client   client.Reader
+	Store    store.Backend
+	Logger   logr.Logger
+	Recorder record.EventRecorder
+	// how often the check runs when the checker is started by the manager
+	Period time.Duration
+	// repair stale marks by rebasing them on the totals of the pod traffic account
+	Repair bool
+}
+
+// Start runs the check periodically until the context is done.
+func (c *Checker) Start(ctx context.Context) error {
+	ticker := time.NewTicker(c.Period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if _, err := c.Check(ctx); err != nil {
+				c.Logger.Error(err, "failed to check the port feeds")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection makes sure only one replica checks and repairs the port feeds.
+func (c *Checker) NeedLeaderElection() bool {
+	return true
+}
+
+// Check compares the port feeds of all port feed requests with their pod traffic accounts
+// and reports the discrepancies found. If Repair is set, stale marks are repaired.
+func (c *Checker) Check(ctx context.Context) ([]Discrepancy, error) {
+	var pfrs nmv1alpha1.PortFeedRequestList
+	if err := c.Client.List(ctx, &pfrs); err != nil {
+		return nil, err
+	}
+	var found []Discrepancy
+	for i := range pfrs.Items {
+		pfr := &pfrs.Items[i]
+		ds, err := c.checkPortFeed(ctx, pfr)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range ds {
+			c.Logger.Info("found a discrepancy", "discrepancy", d.String())
+			if c.Recorder != nil {
+				c.Recorder.Event(pfr, corev1.EventTypeWarning, "PortFeedDiscrepancy", d.String())
+			}
+			if c.Repair && d.Kind == KIND_STALE_MARK {
+				if err := c.repair(ctx, pfr, d); err != nil {
+					return nil, err
+				}
+			}
+		}
+		found = append(found, ds...)
+	}
+	counts := map[string]float64{
+		KIND_STALE_MARK:  0,
+		KIND_LAGGING:     0,
+		KIND_OVERCOUNTED: 0,
+		KIND_ORPHANED:    0,
+	}
+	for _, d := range found {
+		counts[d.Kind]++
+	}
+	for kind, count := range counts {
+		discrepancies.WithLabelValues(kind).Set(count)
+	}
+	return found, nil
+}
+
+func (c *Checker) checkPortFeed(ctx context.Context, pfr *nmv1alpha1.PortFeedRequest) ([]Discrepancy, error) {
+	pf_id := fmt.Sprintf("%s/%s", pfr.Spec.AssociatedNamespace, pfr.Spec.AssociatedPod)
+	tag := fmt.Sprint(pfr.Spec.Port)
+	var pf store.PortFeed
+	pfFound, err := c.Store.FindPF(ctx, pf_id, &pf)
+	if err != nil {
+		return nil, err
+	}
+	nn := types.NamespacedName{
+		Namespace: pfr.Spec.AssociatedNamespace,
+		Name:      pfr.Spec.AssociatedPod,
+	}
+	var pta store.PodTrafficAccount
+	ptaFound, err := c.Store.FindPTA(ctx, nn.String(), &pta)
+	if err != nil {
+		return nil, err
+	}
+	// the port feed request should have caught up with the account if it has been
+	// synchronized twice since the account was last seen
+	lagAllowed := pfr.Status.LastSyncTime.IsZero() ||
+		time.Since(pfr.Status.LastSyncTime.Time) < 2*pfr.Spec.SyncPeriod.Duration
+
+	var ds []Discrepancy
+	newDiscrepancy := func(addr string, kind string, pfTP, ptaTP store.TagProperty) Discrepancy {
+		return Discrepancy{
+			PortFeedRequest: client.ObjectKeyFromObject(pfr),
+			PortFeed:        pf_id,
+			Address:         addr,
+			Tag:             tag,
+			Kind:            kind,
+			PortFeedMark:    pfTP.CurSentByteMark,
+			PortFeedBytes:   pfTP.SentBytes,
+			AccountBytes:    ptaTP.SentBytes,
+		}
+	}
+	if ptaFound && pta.AddressProperties != nil {
+		for addr := range pta.AddressProperties {
+			var pfTP, ptaTP store.TagProperty
+			if pfFound {
+				if err := pf.GetTagProperty(addr, tag, true, &pfTP); err != nil {
+					return nil, err
+				}
+			}
+			if err := pta.GetTagProperty(addr, tag, true, &ptaTP); err != nil {
+				return nil, err
+			}
+			switch {
+			case pfTP.CurSentByteMark > ptaTP.SentBytes:
+				ds = append(ds, newDiscrepancy(addr, KIND_STALE_MARK, pfTP, ptaTP))
+			case pfTP.CurSentByteMark < ptaTP.SentBytes && !lagAllowed:
+				ds = append(ds, newDiscrepancy(addr, KIND_LAGGING, pfTP, ptaTP))
+			}
+			if pfTP.SentBytes > ptaTP.SentBytes {
+				ds = append(ds, newDiscrepancy(addr, KIND_OVERCOUNTED, pfTP, ptaTP))
+			}
+		}
+	}
+	if pfFound && pf.AddressProperties != nil {
+		for addr, ap := range pf.AddressProperties {
+			if _, ok := ap.TagProperties[tag]; !ok {
+				continue
+			}
+			if _, ok := pta.AddressProperties[addr]; !ptaFound || !ok {
+				var pfTP store.TagProperty
+				if err := pf.GetTagProperty(addr, tag, true, &pfTP); err != nil {
+					return nil, err
+				}
+				ds = append(ds, newDiscrepancy(addr, KIND_ORPHANED, pfTP, store.TagProperty{}))
+			}
+		}
+	}
+	return ds, nil
+}
+
+// repair rebases the mark of the port feed on the total of the pod traffic account so
+// that the port feed accounts the traffic from now on. The bytes accounted by the port
+// feed so far are kept. A port feed rolled up since the check is left alone; the next
+// check sees it as it is now.
+func (c *Checker) repair(ctx context.Context, pfr *nmv1alpha1.PortFeedRequest, d Discrepancy) error {
+	req := store.PortFeedProp{
+		Namespace: pfr.Spec.AssociatedNamespace,
+		Pod:       pfr.Spec.AssociatedPod,
+		Labels:    store.LabelPairs(pfr.Labels),
+	}
+	tp := store.TagProperty{
+		SentBytes:       d.PortFeedBytes,
+		CurSentByteMark: d.AccountBytes,
+	}
+	observed := store.TagProperty{
+		SentBytes:       d.PortFeedBytes,
+		CurSentByteMark: d.PortFeedMark,
+	}
+	if set, err := c.Store.CompareAndSetPortFeed(ctx, req, d.Address, d.Tag, observed, tp); err != nil {
+		return err
+	} else if !set {
+		c.Logger.Info("the port feed has changed since the check; skip the repair", "discrepancy", d.String())
+		return nil
+	}
+	repairs.Inc()
+	c.Logger.Info("the discrepancy has been repaired", "discrepancy", d.String())
+	if c.Recorder != nil {
+		c.Recorder.Eventf(pfr, corev1.EventTypeNormal, "PortFeedRepaired", "the mark of address %s with tag %s has been rebased to %d", d.Address, d.Tag, d.AccountBytes)
+	}
+	return nil
+}
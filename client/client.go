@@ -3,23 +3,32 @@ package client
 import (
 	"context"
 	"fmt"
+	"net"
 	"time"
 
 	counterpb "github.com/dinoallo/sealos-networkmanager-synchronizer/client/proto/agent"
 	"github.com/go-logr/logr"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 )
 
-const defaultNMAgentPort = "50051"
+const (
+	defaultNMAgentPort = "50051"
+	// The agent reports the identifier of its current session (e.g. its boot id) with
+	// this header. It changes whenever the agent restarts and its counters start over.
+	AgentEpochHeader = "x-nm-agent-epoch"
+)
 
 type Client struct {
 	nodeIP  string
 	conn    *grpc.ClientConn
 	closing bool
+	// the epoch of the agent observed in the last response; empty if the agent doesn't report one
+	epoch string
 	// After calling NewClient, this logger will have the value of nodeIP
 	logger logr.Logger
 }
@@ -33,19 +42,31 @@ func (c *Client) Close() {
 	}
 }
 
-func NewClient(nodeIP string) (*Client, error) {
+// NewClient connects to the agent serving on port of the node; port defaults to 50051 if empty.
+// A nil auth connects in plaintext. It blocks until the connection is up or ctx is done.
+func NewClient(ctx context.Context, nodeIP string, port string, auth *Auth) (*Client, error) {
 	c := &Client{
 		nodeIP: nodeIP,
 		logger: log.Log.WithName("NMAgentClient").WithValues("nodeIP", nodeIP),
 	}
-	address := fmt.Sprintf("%s:%s", nodeIP, defaultNMAgentPort)
-	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithKeepaliveParams(
+	if port == "" {
+		port = defaultNMAgentPort
+	}
+	address := net.JoinHostPort(nodeIP, port)
+	opts, err := auth.DialOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, grpc.WithKeepaliveParams(
 		keepalive.ClientParameters{
 			Time:    time.Minute,
 			Timeout: 5 * time.Second,
 		}),
 		grpc.WithBlock(),
+		// the RPCs are traced as children of the spans of the callers
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
 	)
+	conn, err := grpc.DialContext(ctx, address, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("connect on %s failed: %s", c.nodeIP, err)
 	}
@@ -62,13 +83,29 @@ func (c *Client) DumpTraffic(ctx context.Context, addr string, tagToSync string,
 		Reset_:  reset_,
 	}
 
-	if resp, err := csc.DumpTraffic(ctx, req); err != nil {
+	var header metadata.MD
+	if resp, err := csc.DumpTraffic(ctx, req, grpc.Header(&header)); err != nil {
 		return nil, err
 	} else {
+		c.observeEpoch(header)
 		return resp, nil
 	}
 }
 
+// Epoch returns the session epoch the agent reported with the last response.
+// The counters of an agent are only comparable within the same epoch.
+func (c *Client) Epoch() string {
+	return c.epoch
+}
+
+// observeEpoch records the epoch of a response. A client only lives for one sync, so a
+// change of epoch is told by comparing it with the epoch stored with the account instead.
+func (c *Client) observeEpoch(header metadata.MD) {
+	if values := header.Get(AgentEpochHeader); len(values) > 0 {
+		c.epoch = values[0]
+	}
+}
+
 func (c *Client) Subscribe(ctx context.Context, addr string, port uint32) error {
 	csc := counterpb.NewCountingServiceClient(c.conn)
 	req := &counterpb.SubscribeRequest{
@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Auth describes how the synchronizer authenticates to the agents and verifies them.
+// The files are usually mounted from Secrets; they are read again whenever they change,
+// so rotated certificates and tokens are picked up without a restart.
+type Auth struct {
+	// the CA bundle the certificates of the agents are verified with
+	CAFile string
+	// the client certificate and key presented to the agents; optional
+	CertFile string
+	KeyFile  string
+	// the name the certificates of the agents are verified against instead of their address
+	ServerName string
+	// a bearer token sent with every RPC; optional and only sent over TLS
+	TokenFile string
+	// connect to the agents in plaintext; the other fields are ignored
+	Insecure bool
+
+	mu     sync.Mutex
+	caPool *x509.CertPool
+	cert   *tls.Certificate
+	token  string
+	// the modification times of the files when they were last loaded
+	loaded map[string]time.Time
+}
+
+// DialOptions returns the options to dial an agent with.
+func (a *Auth) DialOptions() ([]grpc.DialOption, error) {
+	if a == nil || a.Insecure {
+		return []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, nil
+	}
+	if a.CAFile == "" {
+		return nil, fmt.Errorf("the CA bundle to verify the agents with is required unless insecure is set")
+	}
+	if (a.CertFile == "") != (a.KeyFile == "") {
+		return nil, fmt.Errorf("the client certificate and the key should be given together")
+	}
+	// load once up front so that a broken setup fails the dial with a clear error
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: a.ServerName,
+		// the chain is verified by verifyConnection against the current CA bundle, which
+		// may have been rotated since the config was built
+		InsecureSkipVerify:   true,
+		VerifyConnection:     a.verifyConnection,
+		GetClientCertificate: a.getClientCertificate,
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))}
+	if a.TokenFile != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{a}))
+	}
+	return opts, nil
+}
+
+func (a *Auth) verifyConnection(cs tls.ConnectionState) error {
+	if err := a.reload(); err != nil {
+		return err
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("the agent didn't present a certificate")
+	}
+	a.mu.Lock()
+	roots := a.caPool
+	a.mu.Unlock()
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+func (a *Auth) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cert == nil {
+		// no client certificate is configured; the agent decides whether that's acceptable
+		return &tls.Certificate{}, nil
+	}
+	return a.cert, nil
+}
+
+func (a *Auth) getToken() (string, error) {
+	if err := a.reload(); err != nil {
+		return "", err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.token, nil
+}
+
+// reload reads the files again if any of them has been modified since they were loaded.
+// Nothing is replaced unless all of them can be loaded.
+func (a *Auth) reload() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	files := []string{a.CAFile, a.CertFile, a.KeyFile, a.TokenFile}
+	modified := make(map[string]time.Time)
+	changed := a.loaded == nil
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modified[f] = info.ModTime()
+		if !info.ModTime().Equal(a.loaded[f]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	pem, err := os.ReadFile(a.CAFile)
+	if err != nil {
+		return err
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificate found in %s", a.CAFile)
+	}
+	var cert *tls.Certificate
+	if a.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(a.CertFile, a.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+	var token string
+	if a.TokenFile != "" {
+		data, err := os.ReadFile(a.TokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(data))
+		if token == "" {
+			return fmt.Errorf("the token in %s is empty", a.TokenFile)
+		}
+	}
+	a.caPool, a.cert, a.token, a.loaded = caPool, cert, token, modified
+	return nil
+}
+
+// tokenCredentials sends the token of the auth as a bearer token with every RPC.
+type tokenCredentials struct {
+	auth *Auth
+}
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := t.auth.getToken()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
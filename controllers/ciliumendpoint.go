@@ -0,0 +1,246 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	nmv1alpha1 "github.com/dinoallo/sealos-networkmanager-synchronizer/api/v1alpha1"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/store"
+)
+
+const (
+	// the CiliumEndpoints are indexed by their endpoint IDs, which are unique per node only
+	CEP_ID_INDEX = "status.id"
+	// the requests are indexed by the endpoint IDs they reference
+	TSR_CEP_ID_INDEX = "spec.ciliumEndpointID"
+)
+
+// CiliumEndpointGVK is the kind of the CiliumEndpoints, which are read as unstructured
+// objects so that the synchronizer doesn't depend on the Cilium API.
+var CiliumEndpointGVK = schema.GroupVersionKind{Group: "cilium.io", Version: "v2", Kind: "CiliumEndpoint"}
+
+//+kubebuilder:rbac:groups=cilium.io,resources=ciliumendpoints,verbs=get;list;watch
+
+func newCiliumEndpoint() *unstructured.Unstructured {
+	cep := &unstructured.Unstructured{}
+	cep.SetGroupVersionKind(CiliumEndpointGVK)
+	return cep
+}
+
+func newCiliumEndpointList() *unstructured.UnstructuredList {
+	ceps := &unstructured.UnstructuredList{}
+	ceps.SetGroupVersionKind(CiliumEndpointGVK.GroupVersion().WithKind(CiliumEndpointGVK.Kind + "List"))
+	return ceps
+}
+
+// endpointStatusOf reads the id, the addresses and the node of a CiliumEndpoint.
+func endpointStatusOf(cep *unstructured.Unstructured) (*nmv1alpha1.EndpointStatus, error) {
+	es := &nmv1alpha1.EndpointStatus{Name: cep.GetName()}
+	id, _, err := unstructured.NestedInt64(cep.Object, "status", "id")
+	if err != nil {
+		return nil, err
+	}
+	es.ID = id
+	if es.NodeIP, _, err = unstructured.NestedString(cep.Object, "status", "networking", "node"); err != nil {
+		return nil, err
+	}
+	addressing, _, err := unstructured.NestedSlice(cep.Object, "status", "networking", "addressing")
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addressing {
+		pair, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, family := range []string{"ipv4", "ipv6"} {
+			addr, ok := pair[family].(string)
+			if !ok || addr == "" {
+				continue
+			}
+			if normalized, err := store.NormalizeIP(addr); err == nil {
+				addr = normalized
+			}
+			es.Addresses = append(es.Addresses, addr)
+		}
+	}
+	return es, nil
+}
+
+// findEndpoint looks up the CiliumEndpoint of the tsr: the one with the endpoint ID on the
+// node of the tsr if the ID is set, or else the one of the pod. It returns nil if there is
+// no such endpoint.
+func (r *TrafficSyncRequestReconciler) findEndpoint(ctx context.Context, tsr *nmv1alpha1.TrafficSyncRequest) (*nmv1alpha1.EndpointStatus, error) {
+	if tsr.Spec.CiliumEndpointID == 0 {
+		cep := newCiliumEndpoint()
+		nn := types.NamespacedName{Namespace: tsr.Spec.AssociatedNamespace, Name: tsr.Spec.AssociatedPod}
+		if err := r.Endpoints.Get(ctx, nn, cep); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return endpointStatusOf(cep)
+	}
+	ceps := newCiliumEndpointList()
+	id := strconv.FormatInt(tsr.Spec.CiliumEndpointID, 10)
+	if err := r.Endpoints.List(ctx, ceps, client.MatchingFields{CEP_ID_INDEX: id}); err != nil {
+		return nil, err
+	}
+	for i := range ceps.Items {
+		es, err := endpointStatusOf(&ceps.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		if tsr.Spec.NodeIP == "" || es.NodeIP == tsr.Spec.NodeIP {
+			return es, nil
+		}
+	}
+	return nil, nil
+}
+
+// refreshEndpoint records the actual state of the CiliumEndpoint of the tsr in its status
+// and flags the differences from the spec. The last known state stays once the endpoint
+// is gone.
+func (r *TrafficSyncRequestReconciler) refreshEndpoint(ctx context.Context, tsr *nmv1alpha1.TrafficSyncRequest) error {
+	es, err := r.findEndpoint(ctx, tsr)
+	if err != nil {
+		return err
+	}
+	cond := metav1.Condition{
+		Type:               nmv1alpha1.CONDITION_ENDPOINT_MATCHED,
+		ObservedGeneration: tsr.Generation,
+	}
+	if es == nil {
+		// the endpoint goes away with the pod, but the final syncs still need its addresses
+		// and node, so the last known ones are kept
+		cond.Status = metav1.ConditionUnknown
+		cond.Reason = "EndpointNotFound"
+		cond.Message = "the CiliumEndpoint of the pod hasn't been found"
+	} else if mismatches := endpointMismatches(tsr, es); len(mismatches) > 0 {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "Mismatch"
+		cond.Message = strings.Join(mismatches, "; ")
+	} else {
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "Matched"
+		cond.Message = "the spec agrees with the CiliumEndpoint of the pod"
+	}
+	if es != nil {
+		tsr.Status.Endpoint = es
+	}
+	if prev := meta.FindStatusCondition(tsr.Status.Conditions, cond.Type); cond.Status == metav1.ConditionFalse &&
+		(prev == nil || prev.Status != cond.Status || prev.Message != cond.Message) && r.Recorder != nil {
+		r.Recorder.Eventf(tsr, corev1.EventTypeWarning, "EndpointMismatch", "the spec disagrees with the CiliumEndpoint %s: %s", es.Name, cond.Message)
+	}
+	meta.SetStatusCondition(&tsr.Status.Conditions, cond)
+	return nil
+}
+
+// endpointMismatches lists how the spec of the tsr differs from the endpoint. The fields
+// left empty in the spec don't count.
+func endpointMismatches(tsr *nmv1alpha1.TrafficSyncRequest, es *nmv1alpha1.EndpointStatus) []string {
+	var mismatches []string
+	if tsr.Spec.CiliumEndpointID != 0 && es.ID != tsr.Spec.CiliumEndpointID {
+		mismatches = append(mismatches, fmt.Sprintf("ciliumEndpointID is %d but the endpoint has %d", tsr.Spec.CiliumEndpointID, es.ID))
+	}
+	if tsr.Spec.NodeIP != "" && es.NodeIP != tsr.Spec.NodeIP {
+		mismatches = append(mismatches, fmt.Sprintf("nodeIP is %s but the endpoint is on %s", tsr.Spec.NodeIP, es.NodeIP))
+	}
+	if specAddrs := specAddresses(tsr); len(specAddrs) > 0 {
+		actual := append([]string(nil), es.Addresses...)
+		sort.Strings(specAddrs)
+		sort.Strings(actual)
+		if strings.Join(specAddrs, ",") != strings.Join(actual, ",") {
+			mismatches = append(mismatches, fmt.Sprintf("the addresses are %s but the endpoint has %s", strings.Join(specAddrs, ","), strings.Join(actual, ",")))
+		}
+	}
+	return mismatches
+}
+
+// requestsOfEndpoint maps a CiliumEndpoint to the requests referencing it by its pod or by
+// its endpoint ID.
+func (r *TrafficSyncRequestReconciler) requestsOfEndpoint(ctx context.Context, cep client.Object) []reconcile.Request {
+	seen := make(map[types.NamespacedName]bool)
+	var reqs []reconcile.Request
+	selectors := []client.MatchingFields{
+		{TSR_POD_INDEX: types.NamespacedName{Namespace: cep.GetNamespace(), Name: cep.GetName()}.String()},
+	}
+	if u, ok := cep.(*unstructured.Unstructured); ok {
+		if id, found, _ := unstructured.NestedInt64(u.Object, "status", "id"); found && id != 0 {
+			selectors = append(selectors, client.MatchingFields{TSR_CEP_ID_INDEX: strconv.FormatInt(id, 10)})
+		}
+	}
+	for _, selector := range selectors {
+		var tsrs nmv1alpha1.TrafficSyncRequestList
+		if err := r.List(ctx, &tsrs, selector); err != nil {
+			r.Logger.Error(err, "unable to list the tsrs of the endpoint", "endpoint", client.ObjectKeyFromObject(cep))
+			continue
+		}
+		for i := range tsrs.Items {
+			key := client.ObjectKeyFromObject(&tsrs.Items[i])
+			if !seen[key] {
+				seen[key] = true
+				reqs = append(reqs, reconcile.Request{NamespacedName: key})
+			}
+		}
+	}
+	return reqs
+}
+
+// endpointChanged reports whether the id, the addresses or the node of a CiliumEndpoint
+// have changed.
+func endpointChanged(oldObj, newObj client.Object) bool {
+	oldCep, ok := oldObj.(*unstructured.Unstructured)
+	if !ok {
+		return true
+	}
+	newCep, ok := newObj.(*unstructured.Unstructured)
+	if !ok {
+		return true
+	}
+	oldEs, err := endpointStatusOf(oldCep)
+	if err != nil {
+		return true
+	}
+	newEs, err := endpointStatusOf(newCep)
+	if err != nil {
+		return true
+	}
+	return !equality.Semantic.DeepEqual(oldEs, newEs)
+}
+
+// setupEndpointIndexes registers the indexes the endpoints of the requests are looked up with.
+func (r *TrafficSyncRequestReconciler) setupEndpointIndexes(ctx context.Context, indexer client.FieldIndexer) error {
+	if err := indexer.IndexField(ctx, newCiliumEndpoint(), CEP_ID_INDEX, func(obj client.Object) []string {
+		u := obj.(*unstructured.Unstructured)
+		id, found, _ := unstructured.NestedInt64(u.Object, "status", "id")
+		if !found || id == 0 {
+			return nil
+		}
+		return []string{strconv.FormatInt(id, 10)}
+	}); err != nil {
+		return err
+	}
+	return indexer.IndexField(ctx, &nmv1alpha1.TrafficSyncRequest{}, TSR_CEP_ID_INDEX, func(obj client.Object) []string {
+		tsr := obj.(*nmv1alpha1.TrafficSyncRequest)
+		if tsr.Spec.CiliumEndpointID == 0 {
+			return nil
+		}
+		return []string{strconv.FormatInt(tsr.Spec.CiliumEndpointID, 10)}
+	})
+}
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"context"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// setFinalizer adds the finalizer to obj, or removes it if present is false, with a merge
+// patch. The finalizers are a list, which a merge patch replaces as a whole, so the patch
+// carries the resource version to keep the finalizers of others; on a conflict obj is read
+// again and the patch retried.
+func setFinalizer(ctx context.Context, c client.Client, obj client.Object, finalizer string, present bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		orig := obj.DeepCopyObject().(client.Object)
+		var changed bool
+		if present {
+			changed = controllerutil.AddFinalizer(obj, finalizer)
+		} else {
+			changed = controllerutil.RemoveFinalizer(obj, finalizer)
+		}
+		if !changed {
+			return nil
+		}
+		err := c.Patch(ctx, obj, client.MergeFromWithOptions(orig, client.MergeFromWithOptimisticLock{}))
+		if apierrors.IsConflict(err) {
+			if err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+				return err
+			}
+		}
+		if !present && apierrors.IsNotFound(err) {
+			// the last finalizer is gone and so is the object
+			return nil
+		}
+		return err
+	})
+}
+
+// patchStatus writes the status of obj changed from orig with a merge patch. The status
+// of the requests is made of maps keyed by tag and of times, so the patch only touches
+// what this reconcile has changed and never conflicts with a stale copy.
+func patchStatus(ctx context.Context, c client.Client, obj client.Object, orig client.Object) error {
+	return c.Status().Patch(ctx, obj, client.MergeFrom(orig))
+}
@@ -18,8 +18,12 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -29,7 +33,10 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	nmv1alpha1 "github.com/dinoallo/sealos-networkmanager-synchronizer/api/v1alpha1"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/schedule"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/sink"
 	"github.com/dinoallo/sealos-networkmanager-synchronizer/store"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/tracing"
 	"github.com/go-logr/logr"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -44,7 +51,13 @@ type PortFeedRequestReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
 	Logger logr.Logger
-	Store  *store.Store
+	Store  store.Backend
+	// receives the updated port feeds; nil if no sink is configured
+	Sinks *sink.Dispatcher
+	// spreads the syncs over the period; nil to sync exactly one period after the last sync
+	Scheduler *schedule.Scheduler
+
+	MaxConcurrentReconciles int
 }
 
 //+kubebuilder:rbac:groups=networking.sealos.io,resources=portfeedrequests,verbs=get;list;watch;create;update;patch;delete
@@ -60,7 +73,14 @@ type PortFeedRequestReconciler struct {
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
-func (r *PortFeedRequestReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *PortFeedRequestReconciler) Reconcile(ctx context.Context, req ctrl.Request) (res ctrl.Result, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "PortFeedRequest.Reconcile",
+		trace.WithAttributes(attribute.String("port_feed_request", req.String())))
+	defer func() { tracing.End(span, err) }()
+	return r.reconcile(ctx, req)
+}
+
+func (r *PortFeedRequestReconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := r.Logger.WithValues("port_feed_request", req.NamespacedName)
 	var pfr nmv1alpha1.PortFeedRequest
 
@@ -77,8 +97,7 @@ func (r *PortFeedRequestReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 			return ctrl.Result{}, err
 		}
 		// if it's successful, we remove the finalizer
-		controllerutil.RemoveFinalizer(&pfr, PFR_FINALIZER_NAME)
-		if err := r.Update(ctx, &pfr); err != nil {
+		if err := setFinalizer(ctx, r.Client, &pfr, PFR_FINALIZER_NAME, false); err != nil {
 			log.Error(err, "unable to remove the finalizer")
 			return ctrl.Result{}, err
 		}
@@ -89,50 +108,40 @@ func (r *PortFeedRequestReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 	// if the tsr doesn't have a finalizer, we add one to prevent there is always a
 	// force re-synchronization before the tsr is deleted
 	if !controllerutil.ContainsFinalizer(&pfr, PFR_FINALIZER_NAME) {
-		controllerutil.AddFinalizer(&pfr, PFR_FINALIZER_NAME)
-		if err := r.Update(ctx, &pfr); err != nil {
+		if err := setFinalizer(ctx, r.Client, &pfr, PFR_FINALIZER_NAME, true); err != nil {
 			log.Error(err, "unable to add the finalizer")
 			return ctrl.Result{}, err
 		}
 	}
-	syncPeriod := pfr.Spec.SyncPeriod
+	syncPeriod := pfr.Spec.SyncPeriod.Duration
+	key := string(pfr.UID)
 	// the time for synchronization has not yet come
-
-	if !r.checkIfSyncRequired(ctx, &pfr) {
-		return ctrl.Result{RequeueAfter: syncPeriod.Duration}, nil
+	due := r.Scheduler.Due(key, syncPeriod, pfr.Status.LastSyncTime.Time)
+	if time.Now().Before(due) {
+		return ctrl.Result{RequeueAfter: r.Scheduler.RequeueAfter(due, syncPeriod)}, nil
 	}
 	if err := r.syncTraffic(ctx, &pfr); err != nil {
 		log.Error(err, "failed to sync traffic")
 		return ctrl.Result{}, err
 	}
+	r.Scheduler.Synced(schedule.KIND_PFR, syncPeriod, due)
 	newPfr := pfr.DeepCopy()
 	newPfr.Status.LastSyncTime = metav1.Now()
 
-	if err := r.Status().Update(ctx, newPfr); err != nil {
+	if err := patchStatus(ctx, r.Client, newPfr, &pfr); err != nil {
 		log.Error(err, "failed to update the status")
 		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{RequeueAfter: syncPeriod.Duration}, nil
-}
-
-func (r *PortFeedRequestReconciler) checkIfSyncRequired(ctx context.Context, pfr *nmv1alpha1.PortFeedRequest) bool {
-	if pfr.Status.LastSyncTime.IsZero() {
-		return true
-	}
-	lst := pfr.Status.LastSyncTime.Time
-	now := metav1.Now().Time
-	sp := pfr.Spec.SyncPeriod
-	if now.Before(lst.Add(sp.Duration)) {
-		return false
-	}
-	return true
+	due = r.Scheduler.Due(key, syncPeriod, newPfr.Status.LastSyncTime.Time)
+	return ctrl.Result{RequeueAfter: r.Scheduler.RequeueAfter(due, syncPeriod)}, nil
 }
 
 func (r *PortFeedRequestReconciler) syncTraffic(ctx context.Context, pfr *nmv1alpha1.PortFeedRequest) error {
 	if pfr == nil || r.Store == nil {
 		return nil
 	}
+	log := r.Logger.WithValues("port_feed_request", client.ObjectKeyFromObject(pfr))
 	pf_id := fmt.Sprintf("%s/%s", pfr.Spec.AssociatedNamespace, pfr.Spec.AssociatedPod)
 	var pfFound bool = false
 	var pf store.PortFeed
@@ -149,6 +158,8 @@ func (r *PortFeedRequestReconciler) syncTraffic(ctx context.Context, pfr *nmv1al
 	nn := _nn.String()
 	tag := fmt.Sprint(pfr.Spec.Port)
 
+	// the rollups of all the addresses are written at once
+	var updates []store.PortFeedUpdate
 	var pta store.PodTrafficAccount
 	if found, err := r.Store.FindPTA(ctx, nn, &pta); err != nil {
 		return err
@@ -175,23 +186,50 @@ func (r *PortFeedRequestReconciler) syncTraffic(ctx context.Context, pfr *nmv1al
 				sentBytes := pfTP.SentBytes
 				if sentByteMark < curSentByteMark {
 					// stale byte mark found; not sync this time
+					log.Info("stale byte mark found; skip the address", "addr", addr, "tag", tag, "mark", curSentByteMark, "account_bytes", sentByteMark)
 					continue
 				}
-				sentBytes += sentByteMark - curSentByteMark
-				req := store.PortFeedProp{
-					Namespace: pfr.Spec.AssociatedNamespace,
-					Pod:       pfr.Spec.AssociatedPod,
+				if pfFound && sentByteMark == curSentByteMark {
+					// rolled up already, e.g. by a sync whose status write failed
+					continue
 				}
+				sentBytes += sentByteMark - curSentByteMark
 				pfTP.SentBytes = sentBytes
 				pfTP.CurSentByteMark = sentByteMark
-				if err := r.Store.UpdatePortFeedByAddr(ctx, req, addr, tag, pfTP); err != nil {
-					return err
-				}
+				updates = append(updates, store.PortFeedUpdate{AddressID: addr, Tag: tag, TP: pfTP})
 			}
 		}
 	}
-
-	return nil
+	if len(updates) == 0 {
+		return nil
+	}
+	req := store.PortFeedProp{
+		Namespace: pfr.Spec.AssociatedNamespace,
+		Pod:       pfr.Spec.AssociatedPod,
+		Labels:    store.LabelPairs(pfr.Labels),
+	}
+	err := r.Store.UpdatePortFeed(ctx, req, updates)
+	var ue *store.PortFeedUpdateError
+	if err != nil && !errors.As(err, &ue) {
+		return err
+	}
+	for i, u := range updates {
+		if ue != nil && ue.Failed[i] != nil {
+			// its mark hasn't moved, so it's rolled up again on the next sync
+			log.Error(ue.Failed[i], "unable to update the port feed", "addr", u.AddressID, "tag", u.Tag)
+			continue
+		}
+		r.Sinks.Publish(sink.Event{
+			Kind:           sink.KIND_ROLLUP,
+			NamespacedName: nn,
+			Address:        u.AddressID,
+			Tag:            u.Tag,
+			PortFeed:       pf_id,
+			SentBytes:      u.TP.SentBytes,
+			Mark:           u.TP.CurSentByteMark,
+		})
+	}
+	return err
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -209,6 +247,6 @@ func (r *PortFeedRequestReconciler) SetupWithManager(mgr ctrl.Manager) error {
 			DeleteFunc: func(de event.DeleteEvent) bool {
 				return true
 			},
-		}).WithOptions(controller.Options{MaxConcurrentReconciles: 5}).
+		}).WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
@@ -0,0 +1,96 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	nmv1alpha1 "github.com/dinoallo/sealos-networkmanager-synchronizer/api/v1alpha1"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/pricing"
+)
+
+// TrafficPricingReconciler keeps the pricing table in line with the TrafficPricing the
+// synchronizer is configured with. Every replica prices the traffic it accounts, so every
+// replica runs it.
+type TrafficPricingReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	Logger logr.Logger
+	// the name of the TrafficPricing in effect
+	Name  string
+	Table *pricing.Table
+}
+
+//+kubebuilder:rbac:groups=networking.sealos.io,resources=trafficpricings,verbs=get;list;watch
+//+kubebuilder:rbac:groups=networking.sealos.io,resources=trafficpricings/status,verbs=get;update;patch
+
+func (r *TrafficPricingReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	return ctrl.Result{}, r.Load(ctx, r.Client)
+}
+
+// Load applies the TrafficPricing read by c. It's called before the manager starts with
+// a reader of the API server, so that no traffic is accounted before the pricing is known.
+func (r *TrafficPricingReconciler) Load(ctx context.Context, c client.Reader) error {
+	log := r.Logger.WithValues("traffic_pricing", r.Name)
+	var tp nmv1alpha1.TrafficPricing
+	if err := c.Get(ctx, client.ObjectKey{Name: r.Name}, &tp); err != nil {
+		if apierrors.IsNotFound(err) {
+			log.Info("the pricing doesn't exist; the traffic is free")
+			r.Table.Clear()
+			return nil
+		}
+		return err
+	}
+	newTp := tp.DeepCopy()
+	if err := r.Table.Set(tp.Spec); err != nil {
+		log.Error(err, "the pricing is invalid; keep the current one")
+		newTp.Status.Error = err.Error()
+	} else {
+		log.Info("the pricing has been applied", "generation", tp.Generation)
+		newTp.Status.ObservedGeneration = tp.Generation
+		newTp.Status.Error = ""
+	}
+	if newTp.Status == tp.Status {
+		return nil
+	}
+	// the status is written by the manager only; before it starts, the next reconcile does it
+	if w, ok := c.(client.Client); ok {
+		return patchStatus(ctx, w, newTp, &tp)
+	}
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *TrafficPricingReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&nmv1alpha1.TrafficPricing{}, builder.WithPredicates(
+			predicate.NewPredicateFuncs(func(o client.Object) bool { return o.GetName() == r.Name }),
+			predicate.GenerationChangedPredicate{},
+		)).
+		WithOptions(controller.Options{NeedLeaderElection: pointer.Bool(false)}).
+		Complete(r)
+}
@@ -18,61 +18,177 @@ package controllers
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	nmv1alpha1 "github.com/dinoallo/sealos-networkmanager-synchronizer/api/v1alpha1"
 	nmaclient "github.com/dinoallo/sealos-networkmanager-synchronizer/client"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/discovery"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/schedule"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/settings"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/sink"
 	"github.com/dinoallo/sealos-networkmanager-synchronizer/store"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/tracing"
 	"github.com/go-logr/logr"
 )
 
 const (
-	AGENT_PORT         = "50051"
 	TSR_FINALIZER_NAME = "networking.sealos.io/tsr-protection"
+
+	// the backoff of a failing tag starts at TAG_RETRY_BASE and doubles with every
+	// failure in a row up to TAG_RETRY_MAX
+	TAG_RETRY_BASE = time.Second * 5
+	TAG_RETRY_MAX  = time.Minute * 5
+
+	// how long connecting to an agent may take; a sync mustn't outlive the ownership of
+	// its shard waiting for an agent which is down
+	AGENT_DIAL_TIMEOUT = time.Second * 5
+
+	// how often the traffic read from an agent is applied again when another replica has
+	// moved the mark meanwhile
+	MARK_CONFLICT_ATTEMPTS = 3
+
+	// why a deleted tsr has been released without its final sync
+	LOST_REASON_FORCE_RELEASED       = "ForceReleased"
+	LOST_REASON_GRACE_PERIOD_EXPIRED = "GracePeriodExpired"
+
+	// the requests are indexed by the namespaced name of their pods
+	TSR_POD_INDEX = "spec.associatedPod"
 )
 
 // TrafficSyncRequestReconciler reconciles a TrafficSyncRequest object
 type TrafficSyncRequestReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
-	Logger logr.Logger
-	Store  *store.Store
+	Scheme   *runtime.Scheme
+	Logger   logr.Logger
+	Recorder record.EventRecorder
+	Store    store.Backend
+	// the live configuration of the synchronizer
+	Config                  *settings.Holder
+	MaxConcurrentReconciles int
+	// splits the requests between the replicas; nil if the leader synchronizes all of them
+	Sharder Sharder
+	// in the node mode, the node this replica synchronizes the requests of and the address
+	// of the agent on the node; both are empty in the central mode
+	NodeIP    string
+	AgentHost string
+	// how the agents are authenticated; nil connects in plaintext
+	AgentAuth *nmaclient.Auth
+	// finds the agent of the node the pod runs on; spec.nodeIP is trusted if nil
+	Resolver *discovery.Resolver
+	// receives the applied deltas; nil if no sink is configured
+	Sinks *sink.Dispatcher
+	// spreads the syncs of the tags over their periods; nil to sync every tag exactly one
+	// period after the last sync
+	Scheduler *schedule.Scheduler
+	// reads the metadata of the pods, so that the tags are synchronized at once when the
+	// pod of a request terminates; the pods aren't watched if nil
+	Pods cache.Cache
+	// reads the CiliumEndpoints, so that the addresses and the node of the requests can be
+	// taken from the endpoints of their pods; the endpoints aren't watched if nil
+	Endpoints cache.Cache
+}
+
+// Sharder decides which replica synchronizes a traffic sync request.
+type Sharder interface {
+	// Owns reports whether this replica synchronizes the requests with the key
+	Owns(key string) bool
+	// Acquire is Owns for a reconcile; the requests with the key aren't handed over to
+	// another replica before done is called
+	Acquire(key string) (done func(), ok bool)
+	// Acquired is notified when this replica has taken over more requests
+	Acquired() <-chan struct{}
 }
 
 // +kubebuilder:rbac:groups=networking.sealos.io,resources=trafficsyncrequests,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=networking.sealos.io,resources=trafficsyncrequests/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=networking.sealos.io,resources=trafficsyncrequests/finalizers,verbs=update
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
 
-func (r *TrafficSyncRequestReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *TrafficSyncRequestReconciler) Reconcile(ctx context.Context, req ctrl.Request) (res ctrl.Result, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "TrafficSyncRequest.Reconcile",
+		trace.WithAttributes(attribute.String("traffic_sync_request", req.String())))
+	defer func() { tracing.End(span, err) }()
+	return r.reconcile(ctx, req)
+}
+
+func (r *TrafficSyncRequestReconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := r.Logger.WithValues("traffic_sync_request", req.NamespacedName)
 	var tsr nmv1alpha1.TrafficSyncRequest
 	if err := r.Get(ctx, req.NamespacedName, &tsr); err != nil {
 		log.Info("unable to fetch the tsr for syncing; ignore for now")
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
+	if r.NodeIP != "" && tsr.Spec.NodeIP != r.NodeIP {
+		// the tsr belongs to another node; the cache should have filtered it out already
+		return ctrl.Result{}, nil
+	}
+	if r.Sharder != nil {
+		done, ok := r.Sharder.Acquire(shardKey(&tsr))
+		if !ok {
+			// another replica synchronizes this tsr; check again later in case it's handed over
+			return ctrl.Result{RequeueAfter: r.nextSyncIn(&tsr)}, nil
+		}
+		defer done()
+	}
 	// first, check if the tsr is set up for deletion
 	// this tsr is set up for deletion
 	if !tsr.DeletionTimestamp.IsZero() {
-		// re-synchronize the last time for this request before deletion
-		for _, tag := range tsr.Spec.Tags {
-			if err := r.syncTraffic(ctx, &tsr, tag); err != nil {
-				log.Error(err, "unable to synchronize the traffic the last time before deletion")
+		// re-synchronize the last time for this request before deletion; a failing tag
+		// doesn't keep the others from their last sync
+		var failed []nmv1alpha1.TagSpec
+		var errs []error
+		locate := r.agentLocator(ctx, &tsr)
+		for _, tag := range tsr.Spec.EffectiveTags() {
+			if tsr.Status.CompletionTime != nil {
+				// synchronized the last time after the pod was deleted already
+				break
+			}
+			if err := r.syncTraffic(ctx, &tsr, tag, locate); err != nil {
+				log.Error(err, "unable to synchronize the traffic the last time before deletion", "tag", tag.Name)
+				failed = append(failed, tag)
+				errs = append(errs, err)
+			}
+		}
+		if len(failed) > 0 {
+			reason, release := r.releaseReason(&tsr)
+			if !release {
+				return ctrl.Result{}, errors.Join(errs...)
+			}
+			if err := r.recordLostAccounting(ctx, &tsr, failed, errs, reason); err != nil {
+				log.Error(err, "unable to record the lost accounting")
 				return ctrl.Result{}, err
 			}
 		}
 		// if it's successful, we remove the finalizer
-		controllerutil.RemoveFinalizer(&tsr, TSR_FINALIZER_NAME)
-		if err := r.Update(ctx, &tsr); err != nil {
+		if err := setFinalizer(ctx, r.Client, &tsr, TSR_FINALIZER_NAME, false); err != nil {
 			log.Error(err, "unable to remove the finalizer")
 			return ctrl.Result{}, err
 		}
@@ -83,120 +199,720 @@ func (r *TrafficSyncRequestReconciler) Reconcile(ctx context.Context, req ctrl.R
 	// if the tsr doesn't have a finalizer, we add one to prevent there is always a
 	// force re-synchronization before the tsr is deleted
 	if !controllerutil.ContainsFinalizer(&tsr, TSR_FINALIZER_NAME) {
-		controllerutil.AddFinalizer(&tsr, TSR_FINALIZER_NAME)
-		if err := r.Update(ctx, &tsr); err != nil {
+		if err := setFinalizer(ctx, r.Client, &tsr, TSR_FINALIZER_NAME, true); err != nil {
 			log.Error(err, "unable to add the finalizer")
 			return ctrl.Result{}, err
 		}
 	}
 
+	if tsr.Status.CompletionTime != nil {
+		// the pod is gone and its traffic has been synchronized the last time
+		return ctrl.Result{}, nil
+	}
+	podGone, podUID, podTerminating, err := r.podState(ctx, &tsr)
+	if err != nil {
+		log.Error(err, "unable to get the pod")
+		return ctrl.Result{}, err
+	}
+	// a pod which has never been seen synchronized may just not be in the cache yet
+	podGone = podGone && len(tsr.Status.LastSyncTime) > 0
+
 	newTsr := tsr.DeepCopy()
-	syncPeriod := newTsr.Spec.SyncPeriod
+	if newTsr.Status.PodUID == "" {
+		newTsr.Status.PodUID = podUID
+	}
+	if r.Endpoints != nil {
+		if err := r.refreshEndpoint(ctx, newTsr); err != nil {
+			log.Error(err, "unable to get the endpoint")
+			return ctrl.Result{}, err
+		}
+	}
 	if newTsr.Status.LastSyncTime == nil {
 		newTsr.Status.LastSyncTime = make(map[string]metav1.Time)
 	}
-	for _, tag := range newTsr.Spec.Tags {
+	if newTsr.Status.Tags == nil {
+		newTsr.Status.Tags = make(map[string]nmv1alpha1.TagSyncStatus)
+	}
+	tags := newTsr.Spec.EffectiveTags()
+	failures := 0
+	locate := r.agentLocator(ctx, newTsr)
+	for _, tag := range tags {
+		due, _ := r.tagDue(newTsr, tag)
+		lst := newTsr.Status.LastSyncTime[tag.Name]
+		if podGone || (podTerminating != nil && lst.Before(podTerminating)) {
+			// catch the traffic up to the end of the pod before the agent forgets it
+			due = time.Now()
+		}
 		// the time for synchronization has not yet come
-		if !r.checkIfSyncRequired(ctx, newTsr, tag) {
+		if time.Now().Before(due) {
 			continue
 		}
-		if err := r.syncTraffic(ctx, newTsr, tag); err != nil {
-			log.Error(err, "failed to sync traffic")
-			return ctrl.Result{}, err
+		ts := newTsr.Status.Tags[tag.Name]
+		ts.LastAttemptTime = metav1.Now()
+		if err := r.syncTraffic(ctx, newTsr, tag, locate); err != nil {
+			// the other tags are synchronized regardless; this one is retried with backoff
+			failures++
+			ts.LastError = err.Error()
+			ts.ConsecutiveFailures++
+			newTsr.Status.Tags[tag.Name] = ts
+			log.Error(err, "failed to sync traffic", "tag", tag.Name, "failures", ts.ConsecutiveFailures)
+			if r.Recorder != nil {
+				r.Recorder.Eventf(newTsr, corev1.EventTypeWarning, "SyncFailed", "failed to sync the traffic of tag %s: %v", tag.Name, err)
+			}
+			continue
+		}
+		r.Scheduler.Synced(schedule.KIND_TSR, tag.Period(), due)
+		ts.LastError = ""
+		ts.ConsecutiveFailures = 0
+		newTsr.Status.Tags[tag.Name] = ts
+		newTsr.Status.LastSyncTime[tag.Name] = ts.LastAttemptTime
+	}
+	pruneStatuses(newTsr, tags)
+	if podGone && failures == 0 {
+		now := metav1.Now()
+		newTsr.Status.CompletionTime = &now
+		log.Info("the pod is gone; the tsr has been completed")
+		if r.Recorder != nil {
+			r.Recorder.Event(newTsr, corev1.EventTypeNormal, "Completed", "the pod is gone and its traffic has been synchronized the last time")
 		}
-		newTsr.Status.LastSyncTime[tag] = metav1.Now()
 	}
 
-	if err := r.Status().Update(ctx, newTsr); err != nil {
+	if err := patchStatus(ctx, r.Client, newTsr, &tsr); err != nil {
+		// the accounting is done; it's based on the marks in the store, so syncing the tags
+		// again because of the stale status doesn't account anything twice
 		log.Error(err, "failed to update the status")
 		return ctrl.Result{}, err
 	}
-	return ctrl.Result{RequeueAfter: syncPeriod.Duration}, nil
+	if newTsr.Status.CompletionTime != nil {
+		return ctrl.Result{}, nil
+	}
+	return ctrl.Result{RequeueAfter: r.nextSyncIn(newTsr)}, nil
+}
+
+// nextSyncIn returns how long it takes until the next tag of the tsr is due; 0 if none of
+// the tags has a period.
+func (r *TrafficSyncRequestReconciler) nextSyncIn(tsr *nmv1alpha1.TrafficSyncRequest) time.Duration {
+	var next time.Duration
+	for _, tag := range tsr.Spec.EffectiveTags() {
+		if tag.Period() <= 0 {
+			continue
+		}
+		var after time.Duration
+		if due, retry := r.tagDue(tsr, tag); retry {
+			// retries keep their backoff exactly; jittering them again is pointless
+			after = time.Until(due)
+			if after < schedule.MIN_REQUEUE {
+				after = schedule.MIN_REQUEUE
+			}
+		} else {
+			after = r.Scheduler.RequeueAfter(due, tag.Period())
+		}
+		if next == 0 || after < next {
+			next = after
+		}
+	}
+	return next
 }
 
-func (r *TrafficSyncRequestReconciler) checkIfSyncRequired(ctx context.Context, tsr *nmv1alpha1.TrafficSyncRequest, tagToSync string) bool {
-	if tsr.Status.LastSyncTime == nil {
-		return true
+// tagDue returns when the tag of the tsr should be synchronized next, and whether that's
+// the retry of a failed attempt.
+func (r *TrafficSyncRequestReconciler) tagDue(tsr *nmv1alpha1.TrafficSyncRequest, tag nmv1alpha1.TagSpec) (time.Time, bool) {
+	if ts, ok := tsr.Status.Tags[tag.Name]; ok && ts.ConsecutiveFailures > 0 {
+		return ts.LastAttemptTime.Add(tagRetryIn(ts.ConsecutiveFailures, tag.Period())), true
 	}
-	if _lst, ok := tsr.Status.LastSyncTime[tagToSync]; !ok {
-		return true
-	} else {
-		now := metav1.Now().Time
-		syncPeriod := tsr.Spec.SyncPeriod
-		if !_lst.IsZero() && now.Before(_lst.Add(syncPeriod.Duration)) {
-			return false
+	return r.Scheduler.Due(scheduleKey(tsr, tag), tag.Period(), tsr.Status.LastSyncTime[tag.Name].Time), false
+}
+
+// tagRetryIn returns the backoff of a tag after the failures in a row. It's capped by the
+// period of the tag, so a failing tag is never tried less often than a healthy one.
+func tagRetryIn(failures int32, period time.Duration) time.Duration {
+	d := TAG_RETRY_MAX
+	if failures <= 16 {
+		d = TAG_RETRY_BASE << (failures - 1)
+	}
+	if d > TAG_RETRY_MAX {
+		d = TAG_RETRY_MAX
+	}
+	if period > 0 && d > period {
+		d = period
+	}
+	return d
+}
+
+// pruneStatuses forgets the progress of the tags and the addresses which have been removed
+// from the spec.
+func pruneStatuses(tsr *nmv1alpha1.TrafficSyncRequest, tags []nmv1alpha1.TagSpec) {
+	inSpec := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		inSpec[tag.Name] = true
+	}
+	for name := range tsr.Status.Tags {
+		if !inSpec[name] {
+			delete(tsr.Status.Tags, name)
+		}
+	}
+	addrInSpec := make(map[string]bool)
+	for _, addr := range addressesOf(tsr) {
+		addrInSpec[addr] = true
+	}
+	for addr, as := range tsr.Status.Addresses {
+		if !addrInSpec[addr] {
+			delete(tsr.Status.Addresses, addr)
+			continue
+		}
+		for name := range as.Tags {
+			if !inSpec[name] {
+				delete(as.Tags, name)
+			}
+		}
+	}
+}
+
+// scheduleKey gives every tag of a tsr a phase of its own, so that the tags of the same
+// request don't hit the agent together either.
+func scheduleKey(tsr *nmv1alpha1.TrafficSyncRequest, tag nmv1alpha1.TagSpec) string {
+	return string(tsr.UID) + "/" + tag.Name
+}
+
+// SyncDue synchronizes once more the tags of all traffic sync requests which are due within
+// window. It's meant to run on shutdown after the manager has stopped, so c should read
+// from the API server directly instead of from the stopped cache.
+func (r *TrafficSyncRequestReconciler) SyncDue(ctx context.Context, c client.Client, window time.Duration) error {
+	var tsrs nmv1alpha1.TrafficSyncRequestList
+	if err := c.List(ctx, &tsrs); err != nil {
+		return err
+	}
+	for i := range tsrs.Items {
+		tsr := &tsrs.Items[i]
+		if !tsr.DeletionTimestamp.IsZero() || tsr.Status.CompletionTime != nil {
+			continue
+		}
+		if r.NodeIP != "" && tsr.Spec.NodeIP != r.NodeIP {
+			continue
+		}
+		log := r.Logger.WithValues("traffic_sync_request", client.ObjectKeyFromObject(tsr))
+		newTsr := tsr.DeepCopy()
+		if newTsr.Status.LastSyncTime == nil {
+			newTsr.Status.LastSyncTime = make(map[string]metav1.Time)
+		}
+		synced := false
+		locate := r.agentLocator(ctx, newTsr)
+		for _, tag := range newTsr.Spec.EffectiveTags() {
+			lst, ok := newTsr.Status.LastSyncTime[tag.Name]
+			if ok && !lst.IsZero() && time.Now().Add(window).Before(lst.Add(tag.Period())) {
+				continue
+			}
+			if err := r.syncTraffic(ctx, newTsr, tag, locate); err != nil {
+				log.Error(err, "failed to sync traffic before shutdown", "tag", tag.Name)
+				continue
+			}
+			newTsr.Status.LastSyncTime[tag.Name] = metav1.Now()
+			synced = true
+		}
+		if synced {
+			if err := patchStatus(ctx, c, newTsr, tsr); err != nil {
+				log.Error(err, "failed to update the status before shutdown")
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		return true
 	}
+	return nil
+}
+
+// agentTarget is where the agent serving the pod of a tsr is reached.
+type agentTarget struct {
+	host string
+	port int
+	// the node the pod runs on, which the traffic is accounted to
+	nodeIP string
+}
+
+// agentLocator returns a function locating the agent serving the pod of the tsr. The agent
+// is located once however many tags are synchronized from it.
+func (r *TrafficSyncRequestReconciler) agentLocator(ctx context.Context, tsr *nmv1alpha1.TrafficSyncRequest) func() (agentTarget, error) {
+	return sync.OnceValues(func() (agentTarget, error) {
+		return r.locateAgent(ctx, tsr)
+	})
+}
+
+func (r *TrafficSyncRequestReconciler) locateAgent(ctx context.Context, tsr *nmv1alpha1.TrafficSyncRequest) (agentTarget, error) {
+	agentCfg := r.Config.Get().Agent
+	target := agentTarget{
+		host:   nodeIPOf(tsr),
+		port:   agentCfg.Port,
+		nodeIP: nodeIPOf(tsr),
+	}
+	if r.AgentHost != "" {
+		target.host = r.AgentHost
+	} else if r.Resolver != nil {
+		// a pod moved to another node is synchronized from the agent of its new node; the
+		// new agent has a different epoch, so its counter is treated as reset
+		pod := types.NamespacedName{
+			Namespace: tsr.Spec.AssociatedNamespace,
+			Name:      tsr.Spec.AssociatedPod,
+		}
+		if host, node, err := r.Resolver.Resolve(ctx, pod); err != nil {
+			return agentTarget{}, err
+		} else {
+			target.host, target.nodeIP = host, node
+		}
+		if agentCfg.Discovery.Port != 0 {
+			target.port = agentCfg.Discovery.Port
+		}
+	}
+	return target, nil
 }
 
-func (r *TrafficSyncRequestReconciler) syncTraffic(ctx context.Context, tsr *nmv1alpha1.TrafficSyncRequest, tagToSync string) error {
+// syncTraffic synchronizes the tag for every address of the tsr from the agent found by
+// locate, and records the progress of each address in the status of the tsr. An address
+// failing doesn't keep the others from being synchronized.
+func (r *TrafficSyncRequestReconciler) syncTraffic(ctx context.Context, tsr *nmv1alpha1.TrafficSyncRequest, tag nmv1alpha1.TagSpec, locate func() (agentTarget, error)) (err error) {
 	if tsr == nil || r.Store == nil {
 		return nil
 	}
-	nodeIP := tsr.Spec.NodeIP
-	addr := tsr.Spec.Address
-	ac, err := nmaclient.NewClient(nodeIP)
+	addrs := addressesOf(tsr)
+	ctx, span := tracing.Tracer().Start(ctx, "TrafficSyncRequest.syncTraffic", trace.WithAttributes(
+		attribute.String("tag", tag.Name),
+		attribute.StringSlice("addresses", addrs),
+	))
+	defer func() { tracing.End(span, err) }()
+	if len(addrs) == 0 {
+		return fmt.Errorf("the tsr has no address")
+	}
+	nn := types.NamespacedName{
+		Namespace: tsr.Spec.AssociatedNamespace,
+		Name:      tsr.Spec.AssociatedPod,
+	}.String()
+	target, err := locate()
+	if err != nil {
+		return err
+	}
+	nodeIP := target.nodeIP
+	span.SetAttributes(attribute.String("node", nodeIP), attribute.String("agent", target.host))
+	dialCtx, dialSpan := tracing.Tracer().Start(ctx, "agent.Dial")
+	dialCtx, cancel := context.WithTimeout(dialCtx, AGENT_DIAL_TIMEOUT)
+	ac, err := nmaclient.NewClient(dialCtx, target.host, strconv.Itoa(target.port), r.AgentAuth)
+	cancel()
+	tracing.End(dialSpan, err)
 	if err != nil {
 		return err
 	}
 	defer ac.Close()
 
-	if resp, err := ac.DumpTraffic(ctx, addr, tagToSync, false); err != nil {
+	var errs []error
+	for _, addr := range addrs {
+		err := r.syncAddress(ctx, ac, tsr, tag, nn, nodeIP, addr)
+		recordAddressProgress(tsr, addr, tag, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// syncAddress synchronizes the tag of an address of the tsr from the agent ac.
+func (r *TrafficSyncRequestReconciler) syncAddress(ctx context.Context, ac *nmaclient.Client, tsr *nmv1alpha1.TrafficSyncRequest, tag nmv1alpha1.TagSpec, nn string, nodeIP string, addr string) error {
+	reset := tag.AccountingMode == nmv1alpha1.ACCOUNTING_MODE_RESET
+	resp, err := ac.DumpTraffic(ctx, addr, tag.Name, reset)
+	if err != nil {
 		return err
-	} else {
-		sentByteMark := resp.SentBytes
-		_nn := types.NamespacedName{
-			Namespace: tsr.Spec.AssociatedNamespace,
-			Name:      tsr.Spec.AssociatedPod,
+	}
+	return r.accountTraffic(ctx, tsr, tag, nn, nodeIP, addr, ac.Epoch(), resp.SentBytes, resp.RecvBytes)
+}
+
+// accountTraffic applies the counters read from the agent, computing the deltas again if
+// another replica has moved the marks meanwhile.
+func (r *TrafficSyncRequestReconciler) accountTraffic(ctx context.Context, tsr *nmv1alpha1.TrafficSyncRequest, tag nmv1alpha1.TagSpec, nn string, nodeIP string, addr string, epoch string, sentBytes, recvBytes uint64) error {
+	for attempt := 1; ; attempt++ {
+		err := r.applyTraffic(ctx, tsr, tag, nn, nodeIP, addr, epoch, sentBytes, recvBytes, attempt > 1)
+		if !errors.Is(err, store.ErrMarkConflict) || attempt >= MARK_CONFLICT_ATTEMPTS {
+			return err
 		}
-		nn := _nn.String()
-		var pta store.PodTrafficAccount
-		var curSentByteMark uint64 = 0
-		if found, err := r.Store.FindPTA(ctx, nn, &pta); err != nil {
+		// the counters read are still good; only the delta is computed again
+		r.Logger.Info("the mark has moved since it was read; apply the traffic again", "namespaced_name", nn, "address", addr, "tag", tag.Name, "attempt", attempt)
+	}
+}
+
+// applyTraffic accounts the counters of the tag of an address read from the agent with
+// the epoch against the marks stored. After a conflict, a mark above the counter has been
+// read later than the counter rather than before a reset.
+func (r *TrafficSyncRequestReconciler) applyTraffic(ctx context.Context, tsr *nmv1alpha1.TrafficSyncRequest, tag nmv1alpha1.TagSpec, nn string, nodeIP string, addr string, epoch string, sentBytes, recvBytes uint64, conflicted bool) error {
+	reset := tag.AccountingMode == nmv1alpha1.ACCOUNTING_MODE_RESET
+	var pta store.PodTrafficAccount
+	var tp store.TagProperty
+	ptaFound, err := r.Store.FindPTA(ctx, nn, &pta)
+	if err != nil {
+		return err
+	} else if ptaFound {
+		if err := pta.GetTagProperty(addr, tag.Name, false, &tp); err != nil {
 			return err
-		} else if found {
-			if err := pta.GetByteMark(addr, tagToSync, 1, false, &curSentByteMark); err != nil {
-				return err
+		}
+	}
+	storedTp := tp
+	if !reset && epoch != "" && tp.Epoch != "" && epoch != tp.Epoch {
+		// the agent has restarted since the marks were taken, so its counters started
+		// over from zero no matter how the values compare
+		r.recordCounterReset(tsr, nodeIP, addr, tag.Name, tp.Epoch, epoch)
+		tp.CurSentByteMark, tp.CurRecvByteMark = 0, 0
+	}
+	var directions []string
+	switch tag.Direction {
+	case nmv1alpha1.TAG_DIRECTION_RECV:
+		directions = []string{store.DIRECTION_RECV}
+	case nmv1alpha1.TAG_DIRECTION_BOTH:
+		directions = []string{store.DIRECTION_SENT, store.DIRECTION_RECV}
+	default:
+		directions = []string{store.DIRECTION_SENT}
+	}
+	for _, direction := range directions {
+		byteMark, curByteMark, storedMark := sentBytes, tp.CurSentByteMark, storedTp.CurSentByteMark
+		if direction == store.DIRECTION_RECV {
+			byteMark, curByteMark, storedMark = recvBytes, tp.CurRecvByteMark, storedTp.CurRecvByteMark
+		}
+		var delta uint64
+		if reset {
+			// the counter has been read and reset as a whole; the mark stays at zero
+			delta, curByteMark, byteMark = byteMark, 0, 0
+		} else {
+			if byteMark < curByteMark && conflicted && epoch == tp.Epoch {
+				// another replica has accounted a later reading already
+				continue
+			}
+			if byteMark < curByteMark {
+				// the marks are stale; reset the mark
+				curByteMark = 0
 			}
+			delta = byteMark - curByteMark
 		}
-		if sentByteMark < curSentByteMark {
-			// the marks are stale; reset the mark
-			curSentByteMark = 0
+		if ptaFound && delta == 0 && byteMark == curByteMark && epoch == tp.Epoch {
+			// nothing new since the last sync, which may have been repeated because its
+			// status write failed; leave the ledger alone
+			continue
 		}
-
-		sentBytes := sentByteMark - curSentByteMark
 		req := store.TagPropReq{
 			NamespacedName: nn,
 			Addr:           addr,
-			Tag:            tagToSync,
+			Tag:            tag.Name,
+			Labels:         store.LabelPairs(tsr.Labels),
 		}
-		if err := r.Store.UpdateFieldUint64(ctx, req, "$inc", "sent_bytes", sentBytes); err != nil {
-			return err
+		entry := store.LedgerEntry{
+			TSR:         client.ObjectKeyFromObject(tsr).String(),
+			Direction:   direction,
+			OldMark:     curByteMark,
+			StoredMark:  storedMark,
+			NewMark:     byteMark,
+			Delta:       delta,
+			Epoch:       epoch,
+			Node:        nodeIP,
+			ReconcileID: string(controller.ReconcileIDFromContext(ctx)),
 		}
-		if err := r.Store.UpdateFieldUint64(ctx, req, "$set", "cur_sent_byte_mark", sentByteMark); err != nil {
+		if err := r.Store.ApplyDelta(ctx, req, entry); err != nil {
 			return err
 		}
+		r.Sinks.Publish(sink.Event{
+			Kind:           sink.KIND_DELTA,
+			NamespacedName: nn,
+			Address:        addr,
+			Tag:            tag.Name,
+			TSR:            entry.TSR,
+			Direction:      entry.Direction,
+			OldMark:        entry.OldMark,
+			NewMark:        entry.NewMark,
+			Delta:          entry.Delta,
+			Epoch:          entry.Epoch,
+			Node:           entry.Node,
+			ReconcileID:    entry.ReconcileID,
+		})
 	}
 	return nil
 }
 
+func (r *TrafficSyncRequestReconciler) recordCounterReset(tsr *nmv1alpha1.TrafficSyncRequest, nodeIP, addr, tag, oldEpoch, newEpoch string) {
+	r.Logger.Info("the agent has restarted; treat the counter as reset", "node", nodeIP, "address", addr, "tag", tag, "old_epoch", oldEpoch, "new_epoch", newEpoch)
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tsr, corev1.EventTypeWarning, "CounterReset", "the agent on %s restarted (epoch %s -> %s); the counter of %s with tag %s is treated as reset", nodeIP, oldEpoch, newEpoch, addr, tag)
+	}
+}
+
+// addressesOf returns the addresses the tsr is synchronized for: those of its endpoint if
+// they're taken from there and the endpoint has been found, or else those of the spec.
+func addressesOf(tsr *nmv1alpha1.TrafficSyncRequest) []string {
+	if es := endpointOf(tsr); es != nil && len(es.Addresses) > 0 {
+		return append([]string(nil), es.Addresses...)
+	}
+	return specAddresses(tsr)
+}
+
+// nodeIPOf returns the node the pod of the tsr runs on, from its endpoint or its spec in
+// the same way as addressesOf.
+func nodeIPOf(tsr *nmv1alpha1.TrafficSyncRequest) string {
+	if es := endpointOf(tsr); es != nil && es.NodeIP != "" {
+		return es.NodeIP
+	}
+	return tsr.Spec.NodeIP
+}
+
+// endpointOf returns the endpoint recorded in the status of the tsr if the addresses of the
+// tsr are taken from it.
+func endpointOf(tsr *nmv1alpha1.TrafficSyncRequest) *nmv1alpha1.EndpointStatus {
+	if tsr.Spec.AddressSource != nmv1alpha1.ADDRESS_SOURCE_CILIUM_ENDPOINT {
+		return nil
+	}
+	return tsr.Status.Endpoint
+}
+
+// specAddresses returns the addresses in the spec of the tsr in their normalized forms. An
+// invalid address is kept as it is, so that its sync fails and the error shows up in the
+// status.
+func specAddresses(tsr *nmv1alpha1.TrafficSyncRequest) []string {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range tsr.Spec.EffectiveAddresses() {
+		if normalized, err := store.NormalizeIP(addr); err == nil {
+			addr = normalized
+		}
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// recordAddressProgress records the result of a sync of the tag of the address in the
+// status of the tsr.
+func recordAddressProgress(tsr *nmv1alpha1.TrafficSyncRequest, addr string, tag nmv1alpha1.TagSpec, err error) {
+	if tsr.Status.Addresses == nil {
+		tsr.Status.Addresses = make(map[string]nmv1alpha1.AddressSyncStatus)
+	}
+	as := tsr.Status.Addresses[addr]
+	if as.Tags == nil {
+		as.Tags = make(map[string]nmv1alpha1.TagSyncStatus)
+	}
+	ts := as.Tags[tag.Name]
+	ts.LastAttemptTime = metav1.Now()
+	if err != nil {
+		ts.LastError = err.Error()
+		ts.ConsecutiveFailures++
+	} else {
+		ts.LastError = ""
+		ts.ConsecutiveFailures = 0
+	}
+	as.Tags[tag.Name] = ts
+	tsr.Status.Addresses[addr] = as
+}
+
+// releaseReason tells whether a deleted tsr whose final sync has failed should be released
+// nevertheless, and why.
+func (r *TrafficSyncRequestReconciler) releaseReason(tsr *nmv1alpha1.TrafficSyncRequest) (string, bool) {
+	if tsr.Annotations[nmv1alpha1.FORCE_RELEASE_ANNOTATION] == "true" {
+		return LOST_REASON_FORCE_RELEASED, true
+	}
+	deletion := r.Config.Get().Deletion
+	if deletion.Policy == settings.DELETION_POLICY_RELEASE && time.Since(tsr.DeletionTimestamp.Time) >= deletion.GracePeriod.Duration {
+		return LOST_REASON_GRACE_PERIOD_EXPIRED, true
+	}
+	return "", false
+}
+
+// recordLostAccounting records the traffic of the failed tags since their last sync as lost
+// before the tsr is released. A forced release goes on even if the store can't record it,
+// since the store being down may be why the final sync failed in the first place.
+func (r *TrafficSyncRequestReconciler) recordLostAccounting(ctx context.Context, tsr *nmv1alpha1.TrafficSyncRequest, failed []nmv1alpha1.TagSpec, errs []error, reason string) error {
+	nn := types.NamespacedName{
+		Namespace: tsr.Spec.AssociatedNamespace,
+		Name:      tsr.Spec.AssociatedPod,
+	}
+	names := make([]string, 0, len(failed))
+	for i, tag := range failed {
+		names = append(names, tag.Name)
+		if r.Store == nil {
+			continue
+		}
+		for _, addr := range addressesOf(tsr) {
+			if ts, ok := tsr.Status.Addresses[addr].Tags[tag.Name]; ok && ts.ConsecutiveFailures == 0 {
+				// this address made it through the final sync
+				continue
+			}
+			lost := store.LostAccounting{
+				TSR:            client.ObjectKeyFromObject(tsr).String(),
+				NamespacedName: nn.String(),
+				Address:        addr,
+				Tag:            tag.Name,
+				Node:           nodeIPOf(tsr),
+				Since:          tsr.Status.LastSyncTime[tag.Name].Time,
+				Reason:         reason,
+				LastError:      errs[i].Error(),
+			}
+			if err := r.Store.RecordLostAccounting(ctx, lost); err != nil {
+				if reason != LOST_REASON_FORCE_RELEASED {
+					return err
+				}
+				r.Logger.Error(err, "unable to record the lost accounting; release the tsr anyway", "traffic_sync_request", client.ObjectKeyFromObject(tsr), "tag", tag.Name, "address", addr)
+			}
+		}
+	}
+	if r.Recorder != nil {
+		r.Recorder.Eventf(tsr, corev1.EventTypeWarning, "AccountingLost", "released (%s) without the final sync of tags %s; their traffic since the last sync is lost", reason, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// shardKey partitions the requests by node, so one replica talks to the agent of a node.
+// It's the node of the spec even if the addresses come from the CiliumEndpoint, since the
+// key mustn't change while the request is being synchronized.
+func shardKey(tsr *nmv1alpha1.TrafficSyncRequest) string {
+	if tsr.Spec.NodeIP != "" {
+		return tsr.Spec.NodeIP
+	}
+	return client.ObjectKeyFromObject(tsr).String()
+}
+
+// shardResyncer enqueues the requests of the shards this replica has just taken over.
+type shardResyncer struct {
+	r      *TrafficSyncRequestReconciler
+	events chan event.GenericEvent
+}
+
+func (s *shardResyncer) Start(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.r.Sharder.Acquired():
+			var tsrs nmv1alpha1.TrafficSyncRequestList
+			if err := s.r.List(ctx, &tsrs); err != nil {
+				s.r.Logger.Error(err, "unable to list the tsrs of the acquired shards")
+				continue
+			}
+			for i := range tsrs.Items {
+				if !s.r.Sharder.Owns(shardKey(&tsrs.Items[i])) {
+					continue
+				}
+				select {
+				case s.events <- event.GenericEvent{Object: &tsrs.Items[i]}:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (s *shardResyncer) NeedLeaderElection() bool {
+	return false
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *TrafficSyncRequestReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&nmv1alpha1.TrafficSyncRequest{}).
-		WithEventFilter(predicate.Funcs{
+	opts := controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}
+	b := ctrl.NewControllerManagedBy(mgr)
+	if r.Sharder != nil || r.NodeIP != "" {
+		// every replica runs the controller and only synchronizes the requests it owns
+		opts.NeedLeaderElection = pointer.Bool(false)
+	}
+	if r.Sharder != nil {
+		resyncer := &shardResyncer{r: r, events: make(chan event.GenericEvent)}
+		if err := mgr.Add(resyncer); err != nil {
+			return err
+		}
+		b = b.WatchesRawSource(&source.Channel{Source: resyncer.events}, &handler.EnqueueRequestForObject{})
+	}
+	if r.Pods != nil || r.Endpoints != nil {
+		if err := mgr.GetFieldIndexer().IndexField(context.Background(), &nmv1alpha1.TrafficSyncRequest{}, TSR_POD_INDEX, func(obj client.Object) []string {
+			tsr := obj.(*nmv1alpha1.TrafficSyncRequest)
+			if tsr.Spec.AssociatedPod == "" {
+				return nil
+			}
+			return []string{podKey(tsr)}
+		}); err != nil {
+			return err
+		}
+	}
+	if r.Endpoints != nil {
+		if err := r.setupEndpointIndexes(context.Background(), mgr.GetFieldIndexer()); err != nil {
+			return err
+		}
+		b = b.WatchesRawSource(source.Kind(r.Endpoints, newCiliumEndpoint()), handler.EnqueueRequestsFromMapFunc(r.requestsOfEndpoint), builder.WithPredicates(predicate.Funcs{
+			// the endpoints report their health too; only their identity and addressing matter
+			UpdateFunc: func(ue event.UpdateEvent) bool {
+				return endpointChanged(ue.ObjectOld, ue.ObjectNew)
+			},
+			GenericFunc: func(ge event.GenericEvent) bool { return false },
+		}))
+	}
+	if r.Pods != nil {
+		pod := &metav1.PartialObjectMetadata{}
+		pod.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Pod"))
+		b = b.WatchesRawSource(source.Kind(r.Pods, pod), handler.EnqueueRequestsFromMapFunc(r.requestsOfPod), builder.WithPredicates(predicate.Funcs{
+			// a pod already terminating when the synchronizer starts
+			CreateFunc: func(ce event.CreateEvent) bool { return !ce.Object.GetDeletionTimestamp().IsZero() },
+			UpdateFunc: func(ue event.UpdateEvent) bool {
+				return ue.ObjectOld.GetDeletionTimestamp().IsZero() && !ue.ObjectNew.GetDeletionTimestamp().IsZero()
+			},
+			DeleteFunc:  func(de event.DeleteEvent) bool { return true },
+			GenericFunc: func(ge event.GenericEvent) bool { return false },
+		}))
+	}
+	return b.
+		For(&nmv1alpha1.TrafficSyncRequest{}, builder.WithPredicates(predicate.Funcs{
 			CreateFunc: func(ce event.CreateEvent) bool { return true },
 			UpdateFunc: func(ue event.UpdateEvent) bool {
-				// only reconcile if spec changes
+				// only reconcile if spec changes, or a stuck deletion is forced
 				oldGen := ue.ObjectOld.GetGeneration()
 				newGen := ue.ObjectNew.GetGeneration()
-				return oldGen != newGen
+				forced := ue.ObjectNew.GetAnnotations()[nmv1alpha1.FORCE_RELEASE_ANNOTATION] == "true" &&
+					ue.ObjectOld.GetAnnotations()[nmv1alpha1.FORCE_RELEASE_ANNOTATION] != "true"
+				return oldGen != newGen || forced
 			},
 			DeleteFunc: func(de event.DeleteEvent) bool {
 				return true
 			},
-		}).
-		WithOptions(controller.Options{MaxConcurrentReconciles: 5}).
+		})).
+		WithOptions(opts).
 		Complete(r)
 }
+
+// requestsOfPod maps a terminating or deleted pod to the requests synchronizing its traffic.
+func (r *TrafficSyncRequestReconciler) requestsOfPod(ctx context.Context, pod client.Object) []reconcile.Request {
+	var tsrs nmv1alpha1.TrafficSyncRequestList
+	key := types.NamespacedName{Namespace: pod.GetNamespace(), Name: pod.GetName()}.String()
+	if err := r.List(ctx, &tsrs, client.MatchingFields{TSR_POD_INDEX: key}); err != nil {
+		r.Logger.Error(err, "unable to list the tsrs of the pod", "pod", key)
+		return nil
+	}
+	reqs := make([]reconcile.Request, 0, len(tsrs.Items))
+	for i := range tsrs.Items {
+		reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&tsrs.Items[i])})
+	}
+	return reqs
+}
+
+// podState reports whether the pod of the tsr is gone, or else its uid and since when it's
+// terminating. A pod of the same name but another uid than the one recorded in the status
+// is a new one, e.g. of a StatefulSet, so the pod of the tsr is gone.
+func (r *TrafficSyncRequestReconciler) podState(ctx context.Context, tsr *nmv1alpha1.TrafficSyncRequest) (bool, types.UID, *metav1.Time, error) {
+	if r.Pods == nil || tsr.Spec.AssociatedPod == "" {
+		return false, "", nil, nil
+	}
+	pod := &metav1.PartialObjectMetadata{}
+	pod.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Pod"))
+	nn := types.NamespacedName{Namespace: tsr.Spec.AssociatedNamespace, Name: tsr.Spec.AssociatedPod}
+	if err := r.Pods.Get(ctx, nn, pod); err != nil {
+		if apierrors.IsNotFound(err) {
+			return true, "", nil, nil
+		}
+		return false, "", nil, err
+	}
+	if tsr.Status.PodUID != "" && pod.GetUID() != tsr.Status.PodUID {
+		return true, "", nil, nil
+	}
+	return false, pod.GetUID(), pod.GetDeletionTimestamp(), nil
+}
+
+func podKey(tsr *nmv1alpha1.TrafficSyncRequest) string {
+	return types.NamespacedName{Namespace: tsr.Spec.AssociatedNamespace, Name: tsr.Spec.AssociatedPod}.String()
+}
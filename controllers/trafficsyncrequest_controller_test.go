@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nmv1alpha1 "github.com/dinoallo/sealos-networkmanager-synchronizer/api/v1alpha1"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/store"
+)
+
+// racingStore lets another replica apply its entries right before the next deltas.
+type racingStore struct {
+	*store.BoltStore
+	// the entries of the other replica, one batch before each of the next deltas
+	races [][]store.LedgerEntry
+	// the deltas attempted, including the refused ones
+	attempts int
+}
+
+func (s *racingStore) ApplyDelta(ctx context.Context, req store.TagPropReq, entry store.LedgerEntry) error {
+	s.attempts++
+	if len(s.races) > 0 {
+		race := s.races[0]
+		s.races = s.races[1:]
+		for _, e := range race {
+			if err := s.BoltStore.ApplyDelta(ctx, req, e); err != nil {
+				return err
+			}
+		}
+	}
+	return s.BoltStore.ApplyDelta(ctx, req, entry)
+}
+
+func TestAccountTrafficAfterConflicts(t *testing.T) {
+	const nn, addr, tag = "default/web-0", "10.0.0.1", "public"
+	// the other replica reads the same counter and applies its reading first
+	read := func(mark uint64) store.LedgerEntry {
+		return store.LedgerEntry{Direction: store.DIRECTION_SENT, NewMark: mark, Delta: mark}
+	}
+	cases := []struct {
+		name     string
+		races    [][]store.LedgerEntry
+		counter  uint64
+		fails    bool
+		attempts int
+		bytes    uint64
+		mark     uint64
+	}{
+		{
+			name:     "no conflict",
+			counter:  100,
+			attempts: 1,
+			bytes:    100,
+			mark:     100,
+		},
+		{
+			name:     "an earlier reading applied meanwhile",
+			races:    [][]store.LedgerEntry{{read(60)}},
+			counter:  100,
+			attempts: 2,
+			bytes:    100,
+			mark:     100,
+		},
+		{
+			// the later reading covers this one, which mustn't be taken for a reset
+			name:     "a later reading applied meanwhile",
+			races:    [][]store.LedgerEntry{{read(150)}},
+			counter:  100,
+			attempts: 1,
+			bytes:    150,
+			mark:     150,
+		},
+		{
+			name: "conflicts on every attempt",
+			races: [][]store.LedgerEntry{
+				{read(10)},
+				{{Direction: store.DIRECTION_SENT, StoredMark: 10, OldMark: 10, NewMark: 20, Delta: 10}},
+				{{Direction: store.DIRECTION_SENT, StoredMark: 20, OldMark: 20, NewMark: 30, Delta: 10}},
+			},
+			counter:  100,
+			fails:    true,
+			attempts: MARK_CONFLICT_ATTEMPTS,
+			bytes:    30,
+			mark:     30,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			log := logr.Discard()
+			bolt := &store.BoltStore{Path: filepath.Join(t.TempDir(), "store.db"), Log: &log}
+			if err := bolt.Launch(ctx); err != nil {
+				t.Fatalf("unable to launch the store: %v", err)
+			}
+			defer bolt.Close(ctx)
+			s := &racingStore{BoltStore: bolt, races: c.races}
+			r := &TrafficSyncRequestReconciler{Store: s, Logger: log}
+			tsr := &nmv1alpha1.TrafficSyncRequest{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-0"}}
+
+			err := r.accountTraffic(ctx, tsr, nmv1alpha1.TagSpec{Name: tag}, nn, "192.168.0.1", addr, "", c.counter, 0)
+			if (err != nil) != c.fails || (c.fails && !errors.Is(err, store.ErrMarkConflict)) {
+				t.Fatalf("accountTraffic() = %v; want it to fail with a conflict: %v", err, c.fails)
+			}
+			if s.attempts != c.attempts {
+				t.Errorf("the delta has been attempted %d times; want %d", s.attempts, c.attempts)
+			}
+			var pta store.PodTrafficAccount
+			var tp store.TagProperty
+			if found, err := bolt.FindPTA(ctx, nn, &pta); err != nil || !found {
+				t.Fatalf("unable to find the account: %v", err)
+			}
+			if err := pta.GetTagProperty(addr, tag, false, &tp); err != nil {
+				t.Fatal(err)
+			}
+			if tp.SentBytes != c.bytes || tp.CurSentByteMark != c.mark {
+				t.Errorf("the account has %d bytes up to the mark %d; want %d up to %d", tp.SentBytes, tp.CurSentByteMark, c.bytes, c.mark)
+			}
+		})
+	}
+}
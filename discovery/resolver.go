@@ -0,0 +1,87 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// NODE_NAME_INDEX indexes the cached agent pods by the node they run on.
+const NODE_NAME_INDEX = "spec.nodeName"
+
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+
+// Resolver finds the agent serving a pod by looking up the node the pod currently runs on
+// and the agent pod of the DaemonSet on that node, so that a rescheduled pod is synchronized
+// from its new node no matter what the request says.
+type Resolver struct {
+	// reads the agent pods; expected to be the cache of the manager restricted by CacheOptions
+	Client client.Reader
+	// reads the pods being synchronized, which aren't cached to save memory
+	APIReader client.Reader
+	// where the agent pods run and how they are labeled
+	Namespace string
+	Selector  labels.Selector
+}
+
+// CacheOptions restricts the pods cached by the manager to the agent pods.
+func (r *Resolver) CacheOptions() cache.ByObject {
+	return cache.ByObject{
+		Label: r.Selector,
+		Field: fields.OneTermEqualSelector("metadata.namespace", r.Namespace),
+	}
+}
+
+// SetupIndexes registers the index the agent pods are looked up with.
+func (r *Resolver) SetupIndexes(ctx context.Context, indexer client.FieldIndexer) error {
+	return indexer.IndexField(ctx, &corev1.Pod{}, NODE_NAME_INDEX, func(obj client.Object) []string {
+		pod := obj.(*corev1.Pod)
+		if pod.Spec.NodeName == "" {
+			return nil
+		}
+		return []string{pod.Spec.NodeName}
+	})
+}
+
+// Resolve returns the address of the agent on the node the pod runs on and the node. The pod
+// is read from the API server, so the result is meant to be shared by all tags of a sync.
+func (r *Resolver) Resolve(ctx context.Context, pod types.NamespacedName) (string, string, error) {
+	var p corev1.Pod
+	if err := r.APIReader.Get(ctx, pod, &p); err != nil {
+		return "", "", fmt.Errorf("unable to find the pod %s: %w", pod, err)
+	}
+	node := p.Spec.NodeName
+	if node == "" {
+		return "", "", fmt.Errorf("the pod %s hasn't been scheduled yet", pod)
+	}
+	var agents corev1.PodList
+	if err := r.Client.List(ctx, &agents,
+		client.InNamespace(r.Namespace),
+		client.MatchingLabelsSelector{Selector: r.Selector},
+		client.MatchingFields{NODE_NAME_INDEX: node},
+	); err != nil {
+		return "", "", err
+	}
+	for i := range agents.Items {
+		agent := &agents.Items[i]
+		if agent.DeletionTimestamp.IsZero() && agent.Status.PodIP != "" && podReady(agent) {
+			return agent.Status.PodIP, node, nil
+		}
+	}
+	return "", "", fmt.Errorf("no ready agent found on the node %s", node)
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
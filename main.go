@@ -18,32 +18,68 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/version"
+	k8sdiscovery "k8s.io/client-go/discovery"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	networkingv1alpha1 "github.com/dinoallo/sealos-networkmanager-synchronizer/api/v1alpha1"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/checker"
+	nmaclient "github.com/dinoallo/sealos-networkmanager-synchronizer/client"
 	"github.com/dinoallo/sealos-networkmanager-synchronizer/controllers"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/discovery"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/pricing"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/schedule"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/settings"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/sharding"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/sink"
 	"github.com/dinoallo/sealos-networkmanager-synchronizer/store"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/tracing"
 	//+kubebuilder:scaffold:imports
 )
 
 const (
-	DB_HOST_ENV = "DB_HOST"
-	DB_PORT_ENV = "DB_PORT"
-	DB_USER_ENV = "DB_USER"
-	DB_NAME_ENV = "DB_NAME"
-	DB_PASS_ENV = "DB_PASS"
+	DB_HOST_ENV       = "DB_HOST"
+	DB_PORT_ENV       = "DB_PORT"
+	DB_USER_ENV       = "DB_USER"
+	DB_NAME_ENV       = "DB_NAME"
+	DB_PASS_ENV       = "DB_PASS"
+	POD_NAME_ENV      = "POD_NAME"
+	POD_NAMESPACE_ENV = "POD_NAMESPACE"
+	HOST_IP_ENV       = "HOST_IP"
+	NODE_NAME_ENV     = "NODE_NAME"
+
+	// the leader election of the manager, with the defaults of controller-runtime; the
+	// final sync has to finish while the lease of the leader is still valid
+	LEADER_LEASE_DURATION = time.Second * 15
+	LEADER_RENEW_DEADLINE = time.Second * 10
+	LEADER_RETRY_PERIOD   = time.Second * 2
+
+	// the node mode watches the tsrs of its node by spec.nodeIP, a selectable field of the
+	// custom resource, which the API server serves since Kubernetes 1.30
+	NODE_MODE_MIN_VERSION = "1.30.0"
 )
 
 var (
@@ -64,14 +100,13 @@ func main() {
 	var dbName string = os.Getenv(DB_NAME_ENV)
 	var dbUser string = os.Getenv(DB_USER_ENV)
 	var dbPass string = os.Getenv(DB_PASS_ENV)
-	var metricsAddr string
-	var enableLeaderElection bool
-	var probeAddr string
-	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
-	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
-	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
-		"Enable leader election for controller manager. "+
-			"Enabling this will ensure there is only one active controller manager.")
+	var configFile string
+	var checkPortFeeds bool
+	flag.StringVar(&configFile, "config", "",
+		"The config file of the synchronizer. Flags given explicitly override the settings in the file.")
+	flag.BoolVar(&checkPortFeeds, "check-port-feeds", false,
+		"Check the port feeds against the pod traffic accounts once and exit instead of running the manager.")
+	configFlags := settings.BindFlags(flag.CommandLine)
 	// configure the logger
 	opts := zap.Options{
 		Development: true,
@@ -81,54 +116,274 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	cfg, err := settings.Load(configFile, configFlags)
+	if err != nil {
+		setupLog.Error(err, "unable to load the config")
+		os.Exit(1)
+	}
+	cfgHolder := settings.NewHolder(cfg)
+
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.Tracing.Enabled {
+		if shutdownTracing, err = tracing.Setup(context.Background(), cfg.Tracing); err != nil {
+			setupLog.Error(err, "unable to set up tracing")
+			os.Exit(1)
+		}
+		setupLog.Info("exporting traces", "endpoint", cfg.Tracing.Endpoint, "sampler", cfg.Tracing.Sampler)
+	}
+
+	restConfig := ctrl.GetConfigOrDie()
+	var hostIP string
+	var cacheOpts cache.Options
+	if cfg.Mode == settings.MODE_NODE {
+		hostIP = os.Getenv(HOST_IP_ENV)
+		if hostIP == "" {
+			setupLog.Error(fmt.Errorf("%s must be set in the node mode", HOST_IP_ENV), "unable to set up the node mode")
+			os.Exit(1)
+		}
+		if err := requireServerVersion(restConfig, NODE_MODE_MIN_VERSION); err != nil {
+			setupLog.Error(err, "unable to set up the node mode")
+			os.Exit(1)
+		}
+		// only watch the tsrs of this node
+		cacheOpts.ByObject = map[client.Object]cache.ByObject{
+			&networkingv1alpha1.TrafficSyncRequest{}: {
+				Field: fields.OneTermEqualSelector("spec.nodeIP", hostIP),
+			},
+		}
+	}
+	var resolver *discovery.Resolver
+	if cfg.Agent.Discovery.Enabled {
+		selector, err := labels.Parse(cfg.Agent.Discovery.LabelSelector)
+		if err != nil {
+			setupLog.Error(err, "unable to set up the agent discovery")
+			os.Exit(1)
+		}
+		resolver = &discovery.Resolver{
+			Namespace: cfg.Agent.Discovery.Namespace,
+			Selector:  selector,
+		}
+		if cacheOpts.ByObject == nil {
+			cacheOpts.ByObject = make(map[client.Object]cache.ByObject)
+		}
+		// only the agent pods are cached
+		cacheOpts.ByObject[&corev1.Pod{}] = resolver.CacheOptions()
+	}
+
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
+		Cache:                  cacheOpts,
 		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "19a8de6d.sealos.io",
+		MetricsBindAddress:     cfg.Manager.MetricsBindAddress,
+		Port:                   cfg.Manager.WebhookPort,
+		HealthProbeBindAddress: cfg.Manager.HealthProbeBindAddress,
+		LeaderElection:         cfg.Manager.LeaderElect,
+		LeaderElectionID:       cfg.Manager.LeaderElectionID,
+		LeaseDuration:          pointer.Duration(LEADER_LEASE_DURATION),
+		RenewDeadline:          pointer.Duration(LEADER_RENEW_DEADLINE),
+		RetryPeriod:            pointer.Duration(LEADER_RETRY_PERIOD),
+		// stop taking new reconciles on termination and wait for the in-flight ones
+		GracefulShutdownTimeout: &cfg.Shutdown.GracePeriod.Duration,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
-	dbCred := store.DBCred{
-		DBHost: dbHost,
-		DBPort: dbPort,
-		DBUser: dbUser,
-		DB:     dbName,
-		DBPass: dbPass,
-	}
 	storeLogger := mgr.GetLogger().WithName("sealos-nm-syncer-store")
-	store := &store.Store{
-		Cred: &dbCred,
-		Log:  &storeLogger,
+	var backend store.Backend
+	var mongoStore *store.Store
+	var pricingTable *pricing.Table
+	var pricer store.Pricer
+	if cfg.Pricing.Enabled {
+		pricingTable = &pricing.Table{}
+		pricer = pricingTable
 	}
-	storeCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	store.Launch(storeCtx)
+	switch cfg.Store.Backend {
+	case store.BACKEND_MONGO:
+		dbCred := store.DBCred{
+			DBHost: dbHost,
+			DBPort: dbPort,
+			DBUser: dbUser,
+			DB:     dbName,
+			DBPass: dbPass,
+		}
+		mongoStore = &store.Store{
+			Cred:              &dbCred,
+			Log:               &storeLogger,
+			InstallValidators: cfg.Store.InstallValidators,
+			MigrationDryRun:   cfg.Store.MigrationDryRun,
+			MaxPoolSize:       cfg.Store.MaxPoolSize,
+			Pricer:            pricer,
+		}
+		mongoStore.SetTimeouts(cfg.Store.ReadTimeout.Duration, cfg.Store.WriteTimeout.Duration)
+		backend = mongoStore
+	case store.BACKEND_BOLT:
+		backend = &store.BoltStore{
+			Path:   cfg.Store.BoltPath,
+			Log:    &storeLogger,
+			Pricer: pricer,
+		}
+	}
+	if checkPortFeeds {
+		if err := backend.Launch(context.Background()); err != nil {
+			setupLog.Error(err, "unable to launch the store")
+		}
+		os.Exit(runPortFeedCheck(backend, cfg.PortFeedCheck.Repair))
+	}
+	if mongoStore != nil && cfg.Store.MigrationDryRun {
+		// a dry run only reports the pending migrations; the synchronizer doesn't serve
+		// on top of a database left unmigrated
+		if err := backend.Launch(context.Background()); !errors.Is(err, store.ErrMigrationDryRun) {
+			setupLog.Error(err, "unable to report the migrations")
+			os.Exit(1)
+		}
+		setupLog.Info("the pending migrations have been reported; exiting")
+		os.Exit(0)
+	}
+	// the manager starts right away, but it won't be ready until the store is
+	storeCtx, stopLaunching := context.WithCancel(context.Background())
+	launched := make(chan struct{})
+	go func() {
+		defer close(launched)
+		store.KeepLaunching(storeCtx, backend, setupLog.WithName("store"))
+	}()
 
-	if err = (&controllers.TrafficSyncRequestReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-		Logger: mgr.GetLogger().WithName("tsr-controller"),
-		Store:  store,
-	}).SetupWithManager(mgr); err != nil {
+	if pricingTable != nil {
+		pricingReconciler := &controllers.TrafficPricingReconciler{
+			Client: mgr.GetClient(),
+			Scheme: mgr.GetScheme(),
+			Logger: mgr.GetLogger().WithName("pricing-controller"),
+			Name:   cfg.Pricing.Name,
+			Table:  pricingTable,
+		}
+		// price the traffic accounted right after the start as well
+		if err := pricingReconciler.Load(context.Background(), mgr.GetAPIReader()); err != nil {
+			setupLog.Error(err, "unable to load the pricing")
+			os.Exit(1)
+		}
+		if err := pricingReconciler.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "TrafficPricing")
+			os.Exit(1)
+		}
+	}
+
+	sinks := newSinks(cfg.Sinks)
+	var scheduler *schedule.Scheduler
+	if cfg.Scheduling.Spread {
+		scheduler = &schedule.Scheduler{
+			Jitter:        cfg.Scheduling.Jitter,
+			StartupSpread: cfg.Scheduling.StartupSpread.Duration,
+		}
+	}
+
+	tsrReconciler := &controllers.TrafficSyncRequestReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Logger:   mgr.GetLogger().WithName("tsr-controller"),
+		Recorder: mgr.GetEventRecorderFor("tsr-controller"),
+		Store:    backend,
+
+		Config:                  cfgHolder,
+		MaxConcurrentReconciles: cfg.Controller.MaxConcurrentReconciles,
+		Sinks:                   sinks,
+		Scheduler:               scheduler,
+		AgentAuth: &nmaclient.Auth{
+			CAFile:     cfg.Agent.TLS.CAFile,
+			CertFile:   cfg.Agent.TLS.CertFile,
+			KeyFile:    cfg.Agent.TLS.KeyFile,
+			ServerName: cfg.Agent.TLS.ServerName,
+			TokenFile:  cfg.Agent.TokenFile,
+			Insecure:   cfg.Agent.Insecure,
+		},
+	}
+	if resolver != nil {
+		resolver.Client = mgr.GetClient()
+		resolver.APIReader = mgr.GetAPIReader()
+		if err := resolver.SetupIndexes(context.Background(), mgr.GetFieldIndexer()); err != nil {
+			setupLog.Error(err, "unable to set up the agent discovery")
+			os.Exit(1)
+		}
+		tsrReconciler.Resolver = resolver
+	}
+	if cfg.Agent.Insecure {
+		setupLog.Info("connecting to the agents in plaintext since agent.insecure is set")
+	}
+	if cfg.Mode == settings.MODE_NODE {
+		tsrReconciler.NodeIP = hostIP
+		tsrReconciler.AgentHost = cfg.Node.AgentHost
+	}
+	if cfg.Sharding.Enabled {
+		coordinator, err := newCoordinator(mgr, cfg.Sharding)
+		if err != nil {
+			setupLog.Error(err, "unable to set up sharding")
+			os.Exit(1)
+		}
+		if err := mgr.Add(coordinator); err != nil {
+			setupLog.Error(err, "unable to set up sharding")
+			os.Exit(1)
+		}
+		tsrReconciler.Sharder = coordinator
+	}
+	if cfg.Controller.WatchPods {
+		pods, err := newPodCache(mgr, cfg)
+		if err != nil {
+			setupLog.Error(err, "unable to set up the pod watch")
+			os.Exit(1)
+		}
+		tsrReconciler.Pods = pods
+	}
+	if cfg.Controller.WatchCiliumEndpoints {
+		tsrReconciler.Endpoints = mgr.GetCache()
+	}
+	if err = tsrReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "TrafficSyncRequest")
 		os.Exit(1)
 	}
 	if err = (&controllers.PortFeedRequestReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-		Logger: mgr.GetLogger().WithName("pfr-controller"),
-		Store:  store,
+		Client:    mgr.GetClient(),
+		Scheme:    mgr.GetScheme(),
+		Logger:    mgr.GetLogger().WithName("pfr-controller"),
+		Store:     backend,
+		Sinks:     sinks,
+		Scheduler: scheduler,
+
+		MaxConcurrentReconciles: cfg.Controller.MaxConcurrentReconciles,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "PortFeedRequest")
 		os.Exit(1)
 	}
 	//+kubebuilder:scaffold:builder
 
+	if cfg.PortFeedCheck.Period.Duration > 0 {
+		if err := mgr.Add(&checker.Checker{
+			Client:   mgr.GetClient(),
+			Store:    backend,
+			Logger:   mgr.GetLogger().WithName("pf-checker"),
+			Recorder: mgr.GetEventRecorderFor("pf-checker"),
+			Period:   cfg.PortFeedCheck.Period.Duration,
+			Repair:   cfg.PortFeedCheck.Repair,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up the port feed checker")
+			os.Exit(1)
+		}
+	}
+
+	if configFile != "" {
+		if err := mgr.Add(&settings.Watcher{
+			Path:   configFile,
+			Flags:  configFlags,
+			Holder: cfgHolder,
+			Logger: mgr.GetLogger().WithName("config-watcher"),
+			OnChange: func(_ *settings.Config, new *settings.Config) {
+				if mongoStore != nil {
+					mongoStore.SetTimeouts(new.Store.ReadTimeout.Duration, new.Store.WriteTimeout.Duration)
+				}
+			},
+		}); err != nil {
+			setupLog.Error(err, "unable to set up the config watcher")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -137,10 +392,210 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if err := mgr.AddReadyzCheck("store", backend.Ready); err != nil {
+		setupLog.Error(err, "unable to set up store ready check")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	signalCtx := ctrl.SetupSignalHandler()
+	// the lease of the leader isn't renewed any more once the manager is told to stop
+	stopRequested := make(chan time.Time, 1)
+	context.AfterFunc(signalCtx, func() { stopRequested <- time.Now() })
+	if err := mgr.Start(signalCtx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+	var leaseUntil time.Time
+	if cfg.Manager.LeaderElect {
+		// the lease was renewed a retry period before the stop at the latest, and the
+		// writes of the final sync need another one to land
+		stoppedAt := time.Now()
+		select {
+		case stoppedAt = <-stopRequested:
+		default:
+		}
+		leaseUntil = stoppedAt.Add(LEADER_LEASE_DURATION - 2*LEADER_RETRY_PERIOD)
+	}
+	// the store mustn't be closed while it's still being launched
+	stopLaunching()
+	<-launched
+	shutdown(mgr, tsrReconciler, backend, cfg.Shutdown, leaseUntil)
+	// flush the spans of the final sync as well
+	flushCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		setupLog.Error(err, "unable to flush the traces")
+	}
+}
+
+func newCoordinator(mgr ctrl.Manager, cfg settings.ShardingConfig) (*sharding.Coordinator, error) {
+	identity := os.Getenv(POD_NAME_ENV)
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		identity = hostname
+	}
+	namespace := os.Getenv(POD_NAMESPACE_ENV)
+	if namespace == "" {
+		return nil, fmt.Errorf("%s must be set when sharding is enabled", POD_NAMESPACE_ENV)
+	}
+	return &sharding.Coordinator{
+		Client:        mgr.GetClient(),
+		Reader:        mgr.GetAPIReader(),
+		Namespace:     namespace,
+		Identity:      identity,
+		Shards:        cfg.Shards,
+		LeaseDuration: cfg.LeaseDuration.Duration,
+		RenewPeriod:   cfg.RenewPeriod.Duration,
+		Logger:        mgr.GetLogger().WithName("sharding"),
+	}, nil
+}
+
+// shutdown runs after the manager has stopped and drained the in-flight reconciles. The
+// leader, or every instance in the node mode, synchronizes the tags due soon once more
+// until leaseUntil unless it's zero, so that no new leader syncs them at the same time;
+// then the store is closed.
+func shutdown(mgr ctrl.Manager, tsrReconciler *controllers.TrafficSyncRequestReconciler, backend store.Backend, cfg settings.ShutdownConfig, leaseUntil time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.GracePeriod.Duration)
+	defer cancel()
+	elected := false
+	select {
+	case <-mgr.Elected():
+		elected = true
+	default:
+	}
+	if tsrReconciler.Sharder != nil && cfg.FinalSyncWindow.Duration > 0 {
+		// the shards have been handed back already, so the other replicas sync them
+		setupLog.Info("skip the final sync since sharding is enabled")
+	} else if !leaseUntil.IsZero() && !time.Now().Before(leaseUntil) {
+		setupLog.Info("skip the final sync since the lease of the leader is about to expire")
+	} else if (elected || tsrReconciler.NodeIP != "") && cfg.FinalSyncWindow.Duration > 0 {
+		setupLog.Info("synchronizing the tags due soon before shutdown", "window", cfg.FinalSyncWindow.Duration)
+		syncCtx := ctx
+		if !leaseUntil.IsZero() {
+			var cancelSync context.CancelFunc
+			syncCtx, cancelSync = context.WithDeadline(ctx, leaseUntil)
+			defer cancelSync()
+		}
+		if c, err := client.New(mgr.GetConfig(), client.Options{Scheme: scheme}); err != nil {
+			setupLog.Error(err, "unable to create the client for the final sync")
+		} else if err := tsrReconciler.SyncDue(syncCtx, c, cfg.FinalSyncWindow.Duration); err != nil {
+			setupLog.Error(err, "unable to finish the final sync")
+		}
+	}
+	// deliver the usage of the final sync before the store goes away
+	tsrReconciler.Sinks.Close(ctx)
+	backend.Close(ctx)
+	setupLog.Info("the synchronizer has shut down")
+}
+
+// newPodCache returns a cache of the metadata of the pods, apart from the cache of the
+// manager which only holds the agent pods with the agent discovery. In the node mode it
+// only holds the pods of the node.
+func newPodCache(mgr ctrl.Manager, cfg *settings.Config) (cache.Cache, error) {
+	opts := cache.Options{
+		Scheme: mgr.GetScheme(),
+		Mapper: mgr.GetRESTMapper(),
+	}
+	if nodeName := os.Getenv(NODE_NAME_ENV); cfg.Mode == settings.MODE_NODE && nodeName != "" {
+		opts.ByObject = map[client.Object]cache.ByObject{
+			&corev1.Pod{}: {Field: fields.OneTermEqualSelector("spec.nodeName", nodeName)},
+		}
+	}
+	c, err := cache.New(mgr.GetConfig(), opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := mgr.Add(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// requireServerVersion fails unless the API server runs min or a later version of Kubernetes.
+func requireServerVersion(restConfig *rest.Config, min string) error {
+	dc, err := k8sdiscovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	info, err := dc.ServerVersion()
+	if err != nil {
+		return fmt.Errorf("unable to get the version of the API server: %v", err)
+	}
+	v, err := version.ParseGeneric(info.GitVersion)
+	if err != nil {
+		return fmt.Errorf("unable to parse the version of the API server %q: %v", info.GitVersion, err)
+	}
+	if v.LessThan(version.MustParseGeneric(min)) {
+		return fmt.Errorf("the API server runs Kubernetes %s, but %s or later is required", info.GitVersion, min)
+	}
+	return nil
+}
+
+// newSinks starts delivering the usage to the sinks enabled by cfg; nil if there are none.
+func newSinks(cfg settings.SinksConfig) *sink.Dispatcher {
+	var sinks []sink.Sink
+	if cfg.Webhook.Enabled {
+		sinks = append(sinks, &sink.Webhook{
+			URL:        cfg.Webhook.URL,
+			SecretFile: cfg.Webhook.SecretFile,
+			MaxRetries: cfg.Webhook.MaxRetries,
+			Timeout:    cfg.Webhook.Timeout.Duration,
+			Client:     &http.Client{},
+		})
+	}
+	if cfg.File.Enabled {
+		sinks = append(sinks, &sink.File{
+			Path:       cfg.File.Path,
+			MaxSize:    int64(cfg.File.MaxSizeMB) << 20,
+			MaxBackups: cfg.File.MaxBackups,
+			Logger:     ctrl.Log.WithName("sinks").WithValues("sink", "file"),
+		})
+	}
+	if cfg.Stdout.Enabled {
+		sinks = append(sinks, sink.Stdout{})
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+	d := &sink.Dispatcher{
+		Logger:        ctrl.Log.WithName("sinks"),
+		QueueSize:     cfg.QueueSize,
+		BatchSize:     cfg.BatchSize,
+		FlushInterval: cfg.FlushInterval.Duration,
+	}
+	d.Start(sinks...)
+	for _, s := range sinks {
+		setupLog.Info("delivering the usage to the sink", "sink", s.Name())
+	}
+	return d
+}
+
+// runPortFeedCheck checks the port feeds once and returns the exit code.
+func runPortFeedCheck(backend store.Backend, repair bool) int {
+	if err := backend.Ready(nil); err != nil {
+		setupLog.Error(err, "the store is not ready")
+		return 1
+	}
+	c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		setupLog.Error(err, "unable to create the client")
+		return 1
+	}
+	pfc := &checker.Checker{
+		Client: c,
+		Store:  backend,
+		Logger: ctrl.Log.WithName("pf-checker"),
+		Repair: repair,
+	}
+	ds, err := pfc.Check(context.Background())
+	if err != nil {
+		setupLog.Error(err, "unable to check the port feeds")
+		return 1
+	}
+	setupLog.Info("the port feeds have been checked", "discrepancies", len(ds), "repaired", repair)
+	return 0
 }
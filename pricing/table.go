@@ -0,0 +1,171 @@
+package pricing
+
+import (
+	"fmt"
+	"math/big"
+	"sync/atomic"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	nmv1alpha1 "github.com/dinoallo/sealos-networkmanager-synchronizer/api/v1alpha1"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/store"
+)
+
+const (
+	GiB = 1 << 30
+	// the tag of the rules applying to the tags without a rule of their own
+	WILDCARD_TAG = "*"
+)
+
+var _ store.Pricer = &Table{}
+
+// Table prices the traffic with the rules of a TrafficPricing. The rules can be replaced
+// at any time; the traffic is free until the first rules are set.
+type Table struct {
+	cur atomic.Pointer[rules]
+}
+
+type rules struct {
+	currency string
+	byKey    map[ruleKey]rule
+}
+
+type ruleKey struct {
+	tag       string
+	direction string
+}
+
+type rule struct {
+	free  uint64
+	tiers []tier
+}
+
+type tier struct {
+	// the end of the tier in bytes; 0 for no end
+	upTo         uint64
+	microsPerGiB int64
+}
+
+// Set replaces the rules with the ones of spec. The current rules stay in effect if spec is invalid.
+func (t *Table) Set(spec nmv1alpha1.TrafficPricingSpec) error {
+	r, err := compile(spec)
+	if err != nil {
+		return err
+	}
+	t.cur.Store(r)
+	return nil
+}
+
+// Clear makes all traffic free.
+func (t *Table) Clear() {
+	t.cur.Store(nil)
+}
+
+func (t *Table) Price(tag string, direction string, periodBytes uint64, delta uint64) (int64, string) {
+	r := t.cur.Load()
+	if r == nil || delta == 0 {
+		return 0, ""
+	}
+	ru, ok := r.byKey[ruleKey{tag: tag, direction: direction}]
+	if !ok {
+		if ru, ok = r.byKey[ruleKey{tag: WILDCARD_TAG, direction: direction}]; !ok {
+			return 0, r.currency
+		}
+	}
+	// the marginal cost; flooring the totals instead of the delta keeps the sum of the
+	// costs of the deltas equal to the cost of the whole period
+	return ru.cost(periodBytes+delta) - ru.cost(periodBytes), r.currency
+}
+
+// cost returns the cost in micro units of the first b bytes of a period.
+func (ru rule) cost(b uint64) int64 {
+	total := new(big.Int)
+	lo := ru.free
+	for _, t := range ru.tiers {
+		if b <= lo {
+			break
+		}
+		hi := b
+		if t.upTo != 0 && t.upTo < hi {
+			hi = t.upTo
+		}
+		if hi > lo {
+			inTier := new(big.Int).SetUint64(hi - lo)
+			total.Add(total, inTier.Mul(inTier, big.NewInt(t.microsPerGiB)))
+		}
+		if t.upTo == 0 {
+			break
+		}
+		if t.upTo > lo {
+			lo = t.upTo
+		}
+	}
+	return total.Quo(total, big.NewInt(GiB)).Int64()
+}
+
+func compile(spec nmv1alpha1.TrafficPricingSpec) (*rules, error) {
+	r := &rules{
+		currency: spec.Currency,
+		byKey:    make(map[ruleKey]rule),
+	}
+	for i, pr := range spec.Rules {
+		direction := pr.Direction
+		if direction == "" {
+			direction = store.DIRECTION_SENT
+		}
+		if direction != store.DIRECTION_SENT && direction != store.DIRECTION_RECV {
+			return nil, fmt.Errorf("rule %d: unknown direction %s", i, direction)
+		}
+		key := ruleKey{tag: pr.Tag, direction: direction}
+		if _, dup := r.byKey[key]; dup {
+			return nil, fmt.Errorf("rule %d: more than one rule for tag %s and direction %s", i, pr.Tag, direction)
+		}
+		var ru rule
+		if pr.FreeGiB != nil {
+			free, err := gibToBytes(*pr.FreeGiB)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: freeGiB: %v", i, err)
+			}
+			ru.free = free
+		}
+		if len(pr.Tiers) == 0 {
+			return nil, fmt.Errorf("rule %d: no tiers", i)
+		}
+		var last uint64
+		for j, pt := range pr.Tiers {
+			var t tier
+			if pt.UpToGiB != nil {
+				upTo, err := gibToBytes(*pt.UpToGiB)
+				if err != nil {
+					return nil, fmt.Errorf("rule %d, tier %d: upToGiB: %v", i, j, err)
+				}
+				if upTo <= last {
+					return nil, fmt.Errorf("rule %d, tier %d: the tiers should be ordered by upToGiB", i, j)
+				}
+				t.upTo, last = upTo, upTo
+			} else if j != len(pr.Tiers)-1 {
+				return nil, fmt.Errorf("rule %d, tier %d: only the last tier may leave upToGiB empty", i, j)
+			}
+			if pt.PricePerGiB.Sign() < 0 {
+				return nil, fmt.Errorf("rule %d, tier %d: the price shouldn't be negative", i, j)
+			}
+			t.microsPerGiB = pt.PricePerGiB.ScaledValue(resource.Micro)
+			ru.tiers = append(ru.tiers, t)
+		}
+		r.byKey[key] = ru
+	}
+	return r, nil
+}
+
+func gibToBytes(q resource.Quantity) (uint64, error) {
+	if q.Sign() < 0 {
+		return 0, fmt.Errorf("%s shouldn't be negative", q.String())
+	}
+	milli := new(big.Int).SetInt64(q.MilliValue())
+	bytes := milli.Mul(milli, big.NewInt(GiB))
+	bytes.Quo(bytes, big.NewInt(1000))
+	if !bytes.IsUint64() {
+		return 0, fmt.Errorf("%s is too large", q.String())
+	}
+	return bytes.Uint64(), nil
+}
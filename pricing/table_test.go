@@ -0,0 +1,227 @@
+package pricing
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	nmv1alpha1 "github.com/dinoallo/sealos-networkmanager-synchronizer/api/v1alpha1"
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/store"
+)
+
+func quantity(s string) *resource.Quantity {
+	q := resource.MustParse(s)
+	return &q
+}
+
+func tieredSpec() nmv1alpha1.TrafficPricingSpec {
+	return nmv1alpha1.TrafficPricingSpec{
+		Currency: "CNY",
+		Rules: []nmv1alpha1.PricingRule{
+			{
+				// the first GiB is free, the next 9 GiB cost 0.1 and the rest 0.05 per GiB
+				Tag:     "public",
+				FreeGiB: quantity("1"),
+				Tiers: []nmv1alpha1.PricingTier{
+					{UpToGiB: quantity("10"), PricePerGiB: resource.MustParse("0.1")},
+					{PricePerGiB: resource.MustParse("0.05")},
+				},
+			},
+			{
+				Tag:   WILDCARD_TAG,
+				Tiers: []nmv1alpha1.PricingTier{{PricePerGiB: resource.MustParse("0.01")}},
+			},
+		},
+	}
+}
+
+func TestPrice(t *testing.T) {
+	var table Table
+	if err := table.Set(tieredSpec()); err != nil {
+		t.Fatalf("unable to set the pricing: %v", err)
+	}
+	cases := []struct {
+		name        string
+		tag         string
+		direction   string
+		periodBytes uint64
+		delta       uint64
+		micros      int64
+		currency    string
+	}{
+		{
+			name:     "inside the free allowance",
+			tag:      "public",
+			delta:    GiB / 2,
+			micros:   0,
+			currency: "CNY",
+		},
+		{
+			name:        "leaving the free allowance",
+			tag:         "public",
+			periodBytes: GiB / 2,
+			delta:       GiB,
+			micros:      50000,
+			currency:    "CNY",
+		},
+		{
+			name:        "crossing a tier boundary",
+			tag:         "public",
+			periodBytes: 9 * GiB,
+			delta:       2 * GiB,
+			micros:      100000 + 50000,
+			currency:    "CNY",
+		},
+		{
+			name:  "spanning all the tiers",
+			tag:   "public",
+			delta: 12 * GiB,
+			// the free GiB, 9 GiB of the first tier and 2 GiB of the second
+			micros:   9*100000 + 2*50000,
+			currency: "CNY",
+		},
+		{
+			name:        "past the last tier",
+			tag:         "public",
+			periodBytes: 20 * GiB,
+			delta:       2 * GiB,
+			micros:      100000,
+			currency:    "CNY",
+		},
+		{
+			name:        "a fraction of a micro unit",
+			tag:         "public",
+			periodBytes: 20 * GiB,
+			delta:       1,
+			micros:      0,
+			currency:    "CNY",
+		},
+		{
+			name:     "a tag without a rule of its own",
+			tag:      "private",
+			delta:    3 * GiB,
+			micros:   30000,
+			currency: "CNY",
+		},
+		{
+			name:      "a direction without a rule",
+			tag:       "public",
+			direction: store.DIRECTION_RECV,
+			delta:     3 * GiB,
+			micros:    0,
+			currency:  "CNY",
+		},
+		{
+			name:     "no delta",
+			tag:      "public",
+			micros:   0,
+			currency: "",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			direction := c.direction
+			if direction == "" {
+				direction = store.DIRECTION_SENT
+			}
+			micros, currency := table.Price(c.tag, direction, c.periodBytes, c.delta)
+			if micros != c.micros || currency != c.currency {
+				t.Errorf("Price(%s, %s, %d, %d) = %d %s; want %d %s", c.tag, direction, c.periodBytes, c.delta, micros, currency, c.micros, c.currency)
+			}
+		})
+	}
+}
+
+// The costs of the deltas of a period add up to the cost of the period however it's split.
+func TestPriceSplitDeltas(t *testing.T) {
+	var table Table
+	if err := table.Set(tieredSpec()); err != nil {
+		t.Fatalf("unable to set the pricing: %v", err)
+	}
+	whole, _ := table.Price("public", store.DIRECTION_SENT, 0, 12*GiB)
+	var sum int64
+	var periodBytes uint64
+	for _, delta := range []uint64{GiB/3 + 7, 5 * GiB, 1, 4*GiB + 12345, 12*GiB - (GiB/3 + 7) - 5*GiB - 1 - (4*GiB + 12345)} {
+		micros, _ := table.Price("public", store.DIRECTION_SENT, periodBytes, delta)
+		sum += micros
+		periodBytes += delta
+	}
+	if sum != whole {
+		t.Errorf("the deltas cost %d in total; want %d", sum, whole)
+	}
+}
+
+// A new pricing applies to the deltas after the swap, continuing at the bytes the period
+// has accumulated under the old one.
+func TestPriceSwappedMidPeriod(t *testing.T) {
+	var table Table
+	if err := table.Set(nmv1alpha1.TrafficPricingSpec{
+		Currency: "CNY",
+		Rules: []nmv1alpha1.PricingRule{{
+			Tag:   "public",
+			Tiers: []nmv1alpha1.PricingTier{{PricePerGiB: resource.MustParse("0.1")}},
+		}},
+	}); err != nil {
+		t.Fatalf("unable to set the pricing: %v", err)
+	}
+	steps := []struct {
+		name        string
+		swap        *nmv1alpha1.TrafficPricingSpec
+		swapFails   bool
+		periodBytes uint64
+		delta       uint64
+		micros      int64
+		currency    string
+	}{
+		{
+			name:     "before the swap",
+			delta:    4 * GiB,
+			micros:   400000,
+			currency: "CNY",
+		},
+		{
+			name: "after the swap",
+			swap: &nmv1alpha1.TrafficPricingSpec{
+				Currency: "USD",
+				Rules: []nmv1alpha1.PricingRule{{
+					Tag: "public",
+					Tiers: []nmv1alpha1.PricingTier{
+						{UpToGiB: quantity("5"), PricePerGiB: resource.MustParse("0.1")},
+						{PricePerGiB: resource.MustParse("0.02")},
+					},
+				}},
+			},
+			periodBytes: 4 * GiB,
+			delta:       2 * GiB,
+			micros:      100000 + 20000,
+			currency:    "USD",
+		},
+		{
+			name: "after an invalid swap",
+			swap: &nmv1alpha1.TrafficPricingSpec{
+				Currency: "EUR",
+				Rules:    []nmv1alpha1.PricingRule{{Tag: "public"}},
+			},
+			swapFails:   true,
+			periodBytes: 6 * GiB,
+			delta:       GiB,
+			micros:      20000,
+			currency:    "USD",
+		},
+	}
+	for _, s := range steps {
+		if s.swap != nil {
+			if err := table.Set(*s.swap); (err != nil) != s.swapFails {
+				t.Fatalf("%s: Set() = %v; want it to fail: %v", s.name, err, s.swapFails)
+			}
+		}
+		micros, currency := table.Price("public", store.DIRECTION_SENT, s.periodBytes, s.delta)
+		if micros != s.micros || currency != s.currency {
+			t.Errorf("%s: Price() = %d %s; want %d %s", s.name, micros, currency, s.micros, s.currency)
+		}
+	}
+	table.Clear()
+	if micros, _ := table.Price("public", store.DIRECTION_SENT, 7*GiB, GiB); micros != 0 {
+		t.Errorf("Price() = %d after Clear; want 0", micros)
+	}
+}
@@ -0,0 +1,148 @@
+package schedule
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	KIND_TSR = "tsr"
+	KIND_PFR = "pfr"
+
+	// the shortest time a request is requeued after, so that an overdue request whose
+	// sync keeps failing doesn't spin
+	MIN_REQUEUE = time.Second
+)
+
+var (
+	syncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sealos_nm_syncer_scheduled_syncs_total",
+		Help: "Total number of syncs run by the schedule",
+	}, []string{"kind"})
+	phases = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sealos_nm_syncer_sync_phase_ratio",
+		Help:    "Position of the syncs within their periods; an even distribution means an even load",
+		Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+	}, []string{"kind"})
+	lateness = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sealos_nm_syncer_sync_lateness_seconds",
+		Help:    "How long after they were due the syncs ran",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"kind"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(syncs, phases, lateness)
+}
+
+// Scheduler spreads the syncs of the requests over their periods instead of letting them
+// all run in the same instant. Every key gets a stable phase within its period, derived
+// from its hash, and is synchronized at that phase once per period. The requests overdue
+// when the synchronizer starts are staggered over StartupSpread instead of being
+// synchronized all at once, and the requeues are delayed by up to Jitter of the period so
+// that the keys sharing a phase drift apart.
+//
+// A nil Scheduler makes a request due exactly one period after its last sync.
+type Scheduler struct {
+	// the fraction of the period the requeues are randomly delayed by at most
+	Jitter float64
+	// the window the syncs overdue at startup are spread over
+	StartupSpread time.Duration
+
+	once    sync.Once
+	started time.Time
+	mu      sync.Mutex
+	rand    *rand.Rand
+}
+
+func (s *Scheduler) init() {
+	s.once.Do(func() {
+		if s.started.IsZero() {
+			s.started = time.Now()
+		}
+		s.rand = rand.New(rand.NewSource(s.started.UnixNano()))
+	})
+}
+
+// Due returns when key, synchronized every period, is due again after its last sync at
+// last. The zero last means it has never been synchronized.
+func (s *Scheduler) Due(key string, period time.Duration, last time.Time) time.Time {
+	if s == nil || period <= 0 {
+		if last.IsZero() {
+			return last
+		}
+		return last.Add(period)
+	}
+	s.init()
+	if last.IsZero() || !last.Add(period).After(s.started) {
+		// overdue since before the start; the requests created later have a zero last
+		// sync too, but their slot in the spread is already over and they run at once
+		return s.started.Add(time.Duration(fraction(key) * float64(s.StartupSpread)))
+	}
+	// the first slot past half a period after the last sync; that's one period later once
+	// the key runs in its slot, and the key moves into its slot within one sync otherwise
+	return nextSlot(last.Add(period/2), offset(key, period), period)
+}
+
+// RequeueAfter returns how long a request should wait for its next sync due at due.
+func (s *Scheduler) RequeueAfter(due time.Time, period time.Duration) time.Duration {
+	if period <= 0 {
+		return 0
+	}
+	d := time.Until(due)
+	if s != nil && s.Jitter > 0 {
+		s.init()
+		s.mu.Lock()
+		d += time.Duration(s.rand.Float64() * s.Jitter * float64(period))
+		s.mu.Unlock()
+	}
+	if d < MIN_REQUEUE {
+		d = MIN_REQUEUE
+	}
+	return d
+}
+
+// Synced records a sync of the kind which was due at due.
+func (s *Scheduler) Synced(kind string, period time.Duration, due time.Time) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	syncs.WithLabelValues(kind).Inc()
+	if period > 0 {
+		pos := time.Duration(now.UnixNano() % int64(period))
+		phases.WithLabelValues(kind).Observe(float64(pos) / float64(period))
+	}
+	if !due.IsZero() && now.After(due) {
+		lateness.WithLabelValues(kind).Observe(now.Sub(due).Seconds())
+	}
+}
+
+// offset returns the phase of key within period, counted from the Unix epoch so that
+// the phase is the same on every replica and across restarts.
+func offset(key string, period time.Duration) time.Duration {
+	return time.Duration(fraction(key) * float64(period))
+}
+
+// fraction maps key uniformly onto [0, 1).
+func fraction(key string) float64 {
+	// fnv barely changes the high bits for keys differing in the last bytes only
+	sum := sha256.Sum256([]byte(key))
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / float64(1<<53)
+}
+
+// nextSlot returns the first instant at or after t whose phase within period is off.
+func nextSlot(t time.Time, off time.Duration, period time.Duration) time.Time {
+	pos := time.Duration(t.UnixNano() % int64(period))
+	wait := off - pos
+	if wait < 0 {
+		wait += period
+	}
+	return t.Add(wait)
+}
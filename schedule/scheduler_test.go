@@ -0,0 +1,98 @@
+package schedule
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDueWithoutScheduler(t *testing.T) {
+	var s *Scheduler
+	last := time.Now()
+	if due := s.Due("a/b", time.Minute, last); !due.Equal(last.Add(time.Minute)) {
+		t.Errorf("Due() = %v; want a period after the last sync at %v", due, last)
+	}
+	if due := s.Due("a/b", time.Minute, time.Time{}); !due.IsZero() {
+		t.Errorf("Due() = %v for a key never synchronized; want at once", due)
+	}
+}
+
+// After the first sync, a key is synchronized in its slot once per period.
+func TestDueKeepsTheSlot(t *testing.T) {
+	period := time.Minute
+	s := &Scheduler{StartupSpread: time.Minute, started: time.Now().Add(-time.Hour)}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("default/pod-%d", i)
+		off := offset(key, period)
+		// synchronized off its slot at first
+		last := time.Now().Add(-time.Second * 7)
+		due := s.Due(key, period, last)
+		if due.Before(last.Add(period/2)) || !due.Before(last.Add(period*3/2)) {
+			t.Errorf("%s: the first due %v is not within half a period around a period after %v", key, due, last)
+		}
+		if pos := time.Duration(due.UnixNano() % int64(period)); pos != off {
+			t.Errorf("%s: the first due is at %v within the period; want %v", key, pos, off)
+		}
+		// then in its slot
+		next := s.Due(key, period, due)
+		if !next.Equal(due.Add(period)) {
+			t.Errorf("%s: due %v after the sync at %v; want one period later", key, next, due)
+		}
+	}
+}
+
+// The keys overdue at startup are spread over the startup window.
+func TestDueSpreadsOverdueKeys(t *testing.T) {
+	started := time.Now()
+	s := &Scheduler{StartupSpread: time.Minute * 10, started: started}
+	var before, after int
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("default/pod-%d", i)
+		for _, last := range []time.Time{{}, started.Add(-time.Hour)} {
+			due := s.Due(key, time.Minute, last)
+			if due.Before(started) || !due.Before(started.Add(s.StartupSpread)) {
+				t.Fatalf("%s: due %v outside of the startup window", key, due)
+			}
+			if due.Before(started.Add(s.StartupSpread / 2)) {
+				before++
+			} else {
+				after++
+			}
+		}
+		if !s.Due(key, time.Minute, time.Time{}).Equal(s.Due(key, time.Minute, time.Time{})) {
+			t.Errorf("%s: the slot in the startup window isn't stable", key)
+		}
+	}
+	if before < 100 || after < 100 {
+		t.Errorf("%d keys are due in the first half of the window and %d in the second; want them spread", before, after)
+	}
+}
+
+func TestRequeueAfter(t *testing.T) {
+	period := time.Minute
+	due := time.Now().Add(time.Second * 30)
+	var none *Scheduler
+	if d := none.RequeueAfter(due, period); d > time.Second*30 || d < time.Second*29 {
+		t.Errorf("RequeueAfter() = %v without jitter; want about 30s", d)
+	}
+	if d := none.RequeueAfter(time.Now().Add(-time.Hour), period); d != MIN_REQUEUE {
+		t.Errorf("RequeueAfter() = %v for an overdue sync; want %v", d, MIN_REQUEUE)
+	}
+	if d := none.RequeueAfter(due, 0); d != 0 {
+		t.Errorf("RequeueAfter() = %v without a period; want 0", d)
+	}
+	s := &Scheduler{Jitter: 0.1}
+	for i := 0; i < 100; i++ {
+		if d := s.RequeueAfter(due, period); d < time.Second*29 || d > time.Second*36 {
+			t.Fatalf("RequeueAfter() = %v with a jitter of 10%%; want within 30s and 36s", d)
+		}
+	}
+}
+
+func TestFraction(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		if f := fraction(fmt.Sprintf("key-%d", i)); f < 0 || f >= 1 {
+			t.Fatalf("fraction() = %v; want it within [0, 1)", f)
+		}
+	}
+}
@@ -0,0 +1,585 @@
+package settings
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/store"
+)
+
+const (
+	API_VERSION = "config.networking.sealos.io/v1alpha1"
+	KIND        = "SynchronizerConfig"
+
+	// the synchronizer runs as a deployment and synchronizes the requests of all nodes
+	MODE_CENTRAL = "central"
+	// the synchronizer runs as a daemonset and synchronizes the requests of its own node
+	MODE_NODE = "node"
+
+	// a deleted traffic sync request is kept until its final sync succeeds
+	DELETION_POLICY_WAIT = "wait"
+	// a deleted traffic sync request is released once its final sync has failed for the
+	// grace period, and the traffic since its last sync is recorded as lost
+	DELETION_POLICY_RELEASE = "release"
+
+	SAMPLER_ALWAYS_ON          = "always_on"
+	SAMPLER_ALWAYS_OFF         = "always_off"
+	SAMPLER_RATIO              = "traceidratio"
+	SAMPLER_PARENT_BASED_RATIO = "parentbased_traceidratio"
+
+	ENV_MODE                      = "NM_SYNCER_MODE"
+	ENV_STORE_BACKEND             = "NM_SYNCER_STORE_BACKEND"
+	ENV_BOLT_PATH                 = "NM_SYNCER_BOLT_PATH"
+	ENV_AGENT_PORT                = "NM_SYNCER_AGENT_PORT"
+	ENV_MAX_CONCURRENT_RECONCILES = "NM_SYNCER_MAX_CONCURRENT_RECONCILES"
+)
+
+// Config is the component configuration of the synchronizer. It's loaded from the file
+// given by --config; environment variables and then command line flags override it.
+type Config struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// central or node; requires a restart. The node mode requires Kubernetes 1.30 or later
+	Mode          string              `json:"mode"`
+	Node          NodeConfig          `json:"node"`
+	Manager       ManagerConfig       `json:"manager"`
+	Controller    ControllerConfig    `json:"controller"`
+	Store         StoreConfig         `json:"store"`
+	Agent         AgentConfig         `json:"agent"`
+	PortFeedCheck PortFeedCheckConfig `json:"portFeedCheck"`
+	Shutdown      ShutdownConfig      `json:"shutdown"`
+	Sharding      ShardingConfig      `json:"sharding"`
+	Tracing       TracingConfig       `json:"tracing"`
+	Sinks         SinksConfig         `json:"sinks"`
+	Pricing       PricingConfig       `json:"pricing"`
+	Scheduling    SchedulingConfig    `json:"scheduling"`
+	Deletion      DeletionConfig      `json:"deletion"`
+}
+
+// NodeConfig applies to the node mode and can only be applied by restarting the synchronizer.
+type NodeConfig struct {
+	// the address the agent of the node is reached at; the synchronizer should run in the
+	// host network for the default to work
+	AgentHost string `json:"agentHost"`
+}
+
+// ManagerConfig can only be applied by restarting the synchronizer.
+type ManagerConfig struct {
+	MetricsBindAddress     string `json:"metricsBindAddress"`
+	HealthProbeBindAddress string `json:"healthProbeBindAddress"`
+	LeaderElect            bool   `json:"leaderElect"`
+	LeaderElectionID       string `json:"leaderElectionID"`
+	WebhookPort            int    `json:"webhookPort"`
+}
+
+// ControllerConfig can only be applied by restarting the synchronizer.
+type ControllerConfig struct {
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles"`
+	// watch the metadata of the pods and synchronize the tags of a request at once when
+	// its pod terminates; the request is completed once the pod is gone
+	WatchPods bool `json:"watchPods"`
+	// watch the CiliumEndpoints, so that the requests can take their addresses and node
+	// from the endpoints of their pods; requires the CRD of Cilium
+	WatchCiliumEndpoints bool `json:"watchCiliumEndpoints"`
+}
+
+type StoreConfig struct {
+	// mongo or bolt; requires a restart
+	Backend string `json:"backend"`
+	// the file of the bolt backend; requires a restart
+	BoltPath string `json:"boltPath"`
+	// the size of the connection pool to mongodb; requires a restart
+	MaxPoolSize uint64 `json:"maxPoolSize"`
+	// the timeouts of mongodb operations; applied live
+	ReadTimeout  metav1.Duration `json:"readTimeout"`
+	WriteTimeout metav1.Duration `json:"writeTimeout"`
+	// requires a restart
+	InstallValidators bool `json:"installValidators"`
+	MigrationDryRun   bool `json:"migrationDryRun"`
+}
+
+type AgentConfig struct {
+	// the port the agents serve on; applied live
+	Port int `json:"port"`
+	// how the agents are verified and the synchronizer authenticates to them; requires a
+	// restart, but the files are read again whenever they change
+	TLS AgentTLSConfig `json:"tls"`
+	// the file holding a bearer token sent with every request; only sent over TLS
+	TokenFile string `json:"tokenFile"`
+	// connect to the agents in plaintext; the counters can be read and forged on the way
+	Insecure bool `json:"insecure"`
+	// find the agents through Kubernetes instead of trusting spec.nodeIP of the requests
+	Discovery AgentDiscoveryConfig `json:"discovery"`
+}
+
+// AgentDiscoveryConfig locates the agent serving a pod among the pods of the agent
+// DaemonSet on the node the pod runs on.
+type AgentDiscoveryConfig struct {
+	// requires a restart, like the namespace and the selector
+	Enabled       bool   `json:"enabled"`
+	Namespace     string `json:"namespace"`
+	LabelSelector string `json:"labelSelector"`
+	// the port the agent pods serve on; agent.port is used if 0. Applied live
+	Port int `json:"port"`
+}
+
+type AgentTLSConfig struct {
+	// the CA bundle the certificates of the agents are verified with
+	CAFile string `json:"caFile"`
+	// the client certificate presented to the agents; optional
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// the name the certificates of the agents are issued for; the address of the agent
+	// is verified if empty
+	ServerName string `json:"serverName"`
+}
+
+type PortFeedCheckConfig struct {
+	// 0 disables the periodic check; requires a restart
+	Period metav1.Duration `json:"period"`
+	Repair bool            `json:"repair"`
+}
+
+// ShutdownConfig can only be applied by restarting the synchronizer.
+type ShutdownConfig struct {
+	// how long the in-flight reconciles and the final syncs may take after a termination signal
+	GracePeriod metav1.Duration `json:"gracePeriod"`
+	// the tags due for synchronization within this window are synchronized once more
+	// before the synchronizer exits; 0 disables the final sync
+	FinalSyncWindow metav1.Duration `json:"finalSyncWindow"`
+}
+
+// ShardingConfig can only be applied by restarting the synchronizer.
+type ShardingConfig struct {
+	// split the traffic sync requests between all replicas instead of letting the leader
+	// synchronize all of them
+	Enabled bool `json:"enabled"`
+	// the number of shards the requests are hashed into; must be the same on all replicas
+	Shards        int             `json:"shards"`
+	LeaseDuration metav1.Duration `json:"leaseDuration"`
+	RenewPeriod   metav1.Duration `json:"renewPeriod"`
+}
+
+// PricingConfig can only be applied by restarting the synchronizer; the TrafficPricing
+// itself is applied live.
+type PricingConfig struct {
+	// accrue the cost of the traffic in the usage of the namespaces
+	Enabled bool `json:"enabled"`
+	// the name of the cluster-scoped TrafficPricing in effect
+	Name string `json:"name"`
+}
+
+// DeletionConfig is applied live.
+type DeletionConfig struct {
+	// wait or release
+	Policy string `json:"policy"`
+	// how long the final sync of a deleted request is retried before it's released
+	GracePeriod metav1.Duration `json:"gracePeriod"`
+}
+
+// SchedulingConfig can only be applied by restarting the synchronizer.
+type SchedulingConfig struct {
+	// sync every request at a stable phase within its period instead of exactly one
+	// period after its last sync
+	Spread bool `json:"spread"`
+	// the fraction of the period the requeues are randomly delayed by at most
+	Jitter float64 `json:"jitter"`
+	// the requests overdue at startup are synchronized over this window instead of at once
+	StartupSpread metav1.Duration `json:"startupSpread"`
+}
+
+// TracingConfig can only be applied by restarting the synchronizer.
+type TracingConfig struct {
+	// export the spans of the reconciles, the agent RPCs and the database commands
+	Enabled bool `json:"enabled"`
+	// the OTLP/gRPC endpoint of the collector, e.g. otel-collector.observability:4317
+	Endpoint string `json:"endpoint"`
+	// connect to the collector in plaintext
+	Insecure bool `json:"insecure"`
+	// always_on, always_off, traceidratio or parentbased_traceidratio
+	Sampler string `json:"sampler"`
+	// the ratio of the traces sampled by the ratio based samplers
+	SamplerRatio float64 `json:"samplerRatio"`
+	ServiceName  string  `json:"serviceName"`
+}
+
+// SinksConfig configures where the usage is delivered as it's accounted. It can only be
+// applied by restarting the synchronizer.
+type SinksConfig struct {
+	// the number of events queued per sink before new ones are dropped
+	QueueSize int `json:"queueSize"`
+	// the most events delivered at once, and how long an incomplete batch waits
+	BatchSize     int               `json:"batchSize"`
+	FlushInterval metav1.Duration   `json:"flushInterval"`
+	Webhook       WebhookSinkConfig `json:"webhook"`
+	File          FileSinkConfig    `json:"file"`
+	Stdout        StdoutSinkConfig  `json:"stdout"`
+}
+
+type WebhookSinkConfig struct {
+	Enabled bool   `json:"enabled"`
+	URL     string `json:"url"`
+	// the file holding the secret the requests are signed with by HMAC-SHA256; optional
+	SecretFile string          `json:"secretFile"`
+	MaxRetries int             `json:"maxRetries"`
+	Timeout    metav1.Duration `json:"timeout"`
+}
+
+type FileSinkConfig struct {
+	Enabled bool   `json:"enabled"`
+	Path    string `json:"path"`
+	// the file is rotated once it exceeds the size
+	MaxSizeMB  int `json:"maxSizeMB"`
+	MaxBackups int `json:"maxBackups"`
+}
+
+type StdoutSinkConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Default returns the configuration used when no file is given.
+func Default() *Config {
+	return &Config{
+		APIVersion: API_VERSION,
+		Kind:       KIND,
+		Mode:       MODE_CENTRAL,
+		Node: NodeConfig{
+			AgentHost: "127.0.0.1",
+		},
+		Manager: ManagerConfig{
+			MetricsBindAddress:     ":8080",
+			HealthProbeBindAddress: ":8081",
+			LeaderElect:            false,
+			LeaderElectionID:       "19a8de6d.sealos.io",
+			WebhookPort:            9443,
+		},
+		Controller: ControllerConfig{
+			MaxConcurrentReconciles: 5,
+			WatchPods:               true,
+		},
+		Store: StoreConfig{
+			Backend:      store.BACKEND_MONGO,
+			BoltPath:     "/data/sealos-nm-syncer.db",
+			MaxPoolSize:  20,
+			ReadTimeout:  metav1.Duration{Duration: time.Second * 5},
+			WriteTimeout: metav1.Duration{Duration: time.Second * 1},
+		},
+		Agent: AgentConfig{
+			Port: 50051,
+		},
+		PortFeedCheck: PortFeedCheckConfig{
+			Period: metav1.Duration{Duration: time.Hour},
+		},
+		Shutdown: ShutdownConfig{
+			GracePeriod: metav1.Duration{Duration: time.Second * 30},
+		},
+		Sharding: ShardingConfig{
+			Shards:        32,
+			LeaseDuration: metav1.Duration{Duration: time.Second * 30},
+			RenewPeriod:   metav1.Duration{Duration: time.Second * 10},
+		},
+		Sinks: SinksConfig{
+			QueueSize:     10000,
+			BatchSize:     100,
+			FlushInterval: metav1.Duration{Duration: time.Second * 5},
+			Webhook: WebhookSinkConfig{
+				MaxRetries: 5,
+				Timeout:    metav1.Duration{Duration: time.Second * 10},
+			},
+			File: FileSinkConfig{
+				Path:       "/data/usage.ndjson",
+				MaxSizeMB:  100,
+				MaxBackups: 5,
+			},
+		},
+		Pricing: PricingConfig{
+			Name: "default",
+		},
+		Deletion: DeletionConfig{
+			Policy:      DELETION_POLICY_RELEASE,
+			GracePeriod: metav1.Duration{Duration: time.Minute * 15},
+		},
+		Scheduling: SchedulingConfig{
+			Spread:        true,
+			Jitter:        0.1,
+			StartupSpread: metav1.Duration{Duration: time.Minute},
+		},
+		Tracing: TracingConfig{
+			Sampler:      SAMPLER_PARENT_BASED_RATIO,
+			SamplerRatio: 0.1,
+			ServiceName:  "sealos-nm-synchronizer",
+		},
+	}
+}
+
+// Validate checks the configuration is complete and consistent.
+func (c *Config) Validate() error {
+	if c.APIVersion != API_VERSION || c.Kind != KIND {
+		return fmt.Errorf("unsupported config %s/%s; expected %s/%s", c.APIVersion, c.Kind, API_VERSION, KIND)
+	}
+	switch c.Mode {
+	case MODE_CENTRAL:
+	case MODE_NODE:
+		if c.Node.AgentHost == "" {
+			return fmt.Errorf("node.agentHost shouldn't be empty in the node mode")
+		}
+		if !c.Manager.LeaderElect {
+			return fmt.Errorf("manager.leaderElect is required in the node mode to elect the instance rolling up the port feeds")
+		}
+		if c.Sharding.Enabled {
+			return fmt.Errorf("sharding can't be enabled in the node mode")
+		}
+		if c.Agent.Discovery.Enabled {
+			return fmt.Errorf("agent.discovery can't be enabled in the node mode")
+		}
+	default:
+		return fmt.Errorf("unknown mode %s", c.Mode)
+	}
+	if c.Manager.LeaderElectionID == "" {
+		return fmt.Errorf("manager.leaderElectionID shouldn't be empty")
+	}
+	if !validPort(c.Manager.WebhookPort) {
+		return fmt.Errorf("manager.webhookPort %d is not a valid port", c.Manager.WebhookPort)
+	}
+	if c.Controller.MaxConcurrentReconciles < 1 {
+		return fmt.Errorf("controller.maxConcurrentReconciles should be at least 1")
+	}
+	switch c.Store.Backend {
+	case store.BACKEND_MONGO:
+		if c.Store.MaxPoolSize < 1 {
+			return fmt.Errorf("store.maxPoolSize should be at least 1")
+		}
+	case store.BACKEND_BOLT:
+		if c.Store.BoltPath == "" {
+			return fmt.Errorf("store.boltPath shouldn't be empty with the bolt backend")
+		}
+	default:
+		return fmt.Errorf("unknown store.backend %s", c.Store.Backend)
+	}
+	if c.Store.ReadTimeout.Duration <= 0 || c.Store.WriteTimeout.Duration <= 0 {
+		return fmt.Errorf("store.readTimeout and store.writeTimeout should be positive")
+	}
+	if !validPort(c.Agent.Port) {
+		return fmt.Errorf("agent.port %d is not a valid port", c.Agent.Port)
+	}
+	if c.Agent.Discovery.Enabled {
+		if c.Agent.Discovery.Namespace == "" || c.Agent.Discovery.LabelSelector == "" {
+			return fmt.Errorf("agent.discovery.namespace and agent.discovery.labelSelector shouldn't be empty")
+		}
+		if _, err := labels.Parse(c.Agent.Discovery.LabelSelector); err != nil {
+			return fmt.Errorf("invalid agent.discovery.labelSelector: %v", err)
+		}
+		if c.Agent.Discovery.Port != 0 && !validPort(c.Agent.Discovery.Port) {
+			return fmt.Errorf("agent.discovery.port %d is not a valid port", c.Agent.Discovery.Port)
+		}
+	}
+	if c.Agent.Insecure {
+		if c.Agent.TokenFile != "" {
+			return fmt.Errorf("agent.tokenFile can't be used with agent.insecure")
+		}
+	} else {
+		// the agents used to be reached in plaintext, so a deployment upgraded without a
+		// configuration ends up here
+		if c.Agent.TLS.CAFile == "" {
+			return fmt.Errorf("agent.tls.caFile is required unless agent.insecure is set; the agents are no longer reached in plaintext by default, see Upgrading in the README")
+		}
+		if (c.Agent.TLS.CertFile == "") != (c.Agent.TLS.KeyFile == "") {
+			return fmt.Errorf("agent.tls.certFile and agent.tls.keyFile should be set together")
+		}
+	}
+	if c.PortFeedCheck.Period.Duration < 0 {
+		return fmt.Errorf("portFeedCheck.period shouldn't be negative")
+	}
+	if c.Shutdown.GracePeriod.Duration < 0 || c.Shutdown.FinalSyncWindow.Duration < 0 {
+		return fmt.Errorf("shutdown.gracePeriod and shutdown.finalSyncWindow shouldn't be negative")
+	}
+	if c.Sharding.Enabled {
+		if c.Sharding.Shards < 1 {
+			return fmt.Errorf("sharding.shards should be at least 1")
+		}
+		if c.Sharding.RenewPeriod.Duration <= 0 || c.Sharding.RenewPeriod.Duration*2 > c.Sharding.LeaseDuration.Duration {
+			return fmt.Errorf("sharding.renewPeriod should be positive and at most half of sharding.leaseDuration")
+		}
+	}
+	if c.Sinks.QueueSize < 1 || c.Sinks.BatchSize < 1 || c.Sinks.FlushInterval.Duration <= 0 {
+		return fmt.Errorf("sinks.queueSize, sinks.batchSize and sinks.flushInterval should be positive")
+	}
+	if c.Sinks.Webhook.Enabled {
+		if u, err := url.Parse(c.Sinks.Webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("sinks.webhook.url %q is not a valid http(s) url", c.Sinks.Webhook.URL)
+		}
+		if c.Sinks.Webhook.MaxRetries < 0 || c.Sinks.Webhook.Timeout.Duration <= 0 {
+			return fmt.Errorf("sinks.webhook.maxRetries shouldn't be negative and sinks.webhook.timeout should be positive")
+		}
+	}
+	if c.Sinks.File.Enabled {
+		if c.Sinks.File.Path == "" {
+			return fmt.Errorf("sinks.file.path shouldn't be empty")
+		}
+		if c.Sinks.File.MaxSizeMB < 0 || c.Sinks.File.MaxBackups < 0 {
+			return fmt.Errorf("sinks.file.maxSizeMB and sinks.file.maxBackups shouldn't be negative")
+		}
+	}
+	if c.Pricing.Enabled && c.Pricing.Name == "" {
+		return fmt.Errorf("pricing.name shouldn't be empty")
+	}
+	switch c.Deletion.Policy {
+	case DELETION_POLICY_WAIT:
+	case DELETION_POLICY_RELEASE:
+		if c.Deletion.GracePeriod.Duration < 0 {
+			return fmt.Errorf("deletion.gracePeriod shouldn't be negative")
+		}
+	default:
+		return fmt.Errorf("unknown deletion.policy %s", c.Deletion.Policy)
+	}
+	if c.Scheduling.Spread {
+		// a sync may be late by the jitter and still has to fall before the next slot
+		if c.Scheduling.Jitter < 0 || c.Scheduling.Jitter >= 0.5 {
+			return fmt.Errorf("scheduling.jitter should be at least 0 and less than 0.5")
+		}
+		if c.Scheduling.StartupSpread.Duration < 0 {
+			return fmt.Errorf("scheduling.startupSpread shouldn't be negative")
+		}
+	}
+	if c.Tracing.Enabled {
+		if c.Tracing.Endpoint == "" {
+			return fmt.Errorf("tracing.endpoint shouldn't be empty")
+		}
+		switch c.Tracing.Sampler {
+		case SAMPLER_ALWAYS_ON, SAMPLER_ALWAYS_OFF, SAMPLER_RATIO, SAMPLER_PARENT_BASED_RATIO:
+		default:
+			return fmt.Errorf("unknown tracing.sampler %s", c.Tracing.Sampler)
+		}
+		if c.Tracing.SamplerRatio < 0 || c.Tracing.SamplerRatio > 1 {
+			return fmt.Errorf("tracing.samplerRatio should be between 0 and 1")
+		}
+	}
+	return nil
+}
+
+func validPort(port int) bool {
+	return port > 0 && port < 65536
+}
+
+// Flags are the command line flags which override the configuration file. Only the flags
+// set explicitly on the command line override it.
+type Flags struct {
+	fs     *flag.FlagSet
+	values Config
+}
+
+// BindFlags registers the flags overriding the configuration file on fs.
+func BindFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{fs: fs}
+	d := Default()
+	v := &f.values
+	fs.StringVar(&v.Manager.MetricsBindAddress, "metrics-bind-address", d.Manager.MetricsBindAddress, "The address the metric endpoint binds to.")
+	fs.StringVar(&v.Manager.HealthProbeBindAddress, "health-probe-bind-address", d.Manager.HealthProbeBindAddress, "The address the probe endpoint binds to.")
+	fs.BoolVar(&v.Manager.LeaderElect, "leader-elect", d.Manager.LeaderElect,
+		"Enable leader election for controller manager. "+
+			"Enabling this will ensure there is only one active controller manager.")
+	fs.StringVar(&v.Store.Backend, "store-backend", d.Store.Backend,
+		"The backend to persist the traffic accounts in: mongo or bolt.")
+	fs.StringVar(&v.Store.BoltPath, "bolt-path", d.Store.BoltPath,
+		"The file of the embedded database when the bolt backend is used.")
+	fs.BoolVar(&v.Store.InstallValidators, "install-db-validators", d.Store.InstallValidators,
+		"Install JSON schema validators on the collections of the database at startup.")
+	fs.BoolVar(&v.Store.MigrationDryRun, "migration-dry-run", d.Store.MigrationDryRun,
+		"Only report what the pending database migrations would change instead of applying them, then exit.")
+	fs.BoolVar(&v.Agent.Insecure, "agent-insecure", d.Agent.Insecure,
+		"Connect to the agents in plaintext without authentication.")
+	fs.DurationVar(&v.PortFeedCheck.Period.Duration, "port-feed-check-period", d.PortFeedCheck.Period.Duration,
+		"How often the manager checks the port feeds against the pod traffic accounts. 0 disables the periodic check.")
+	fs.BoolVar(&v.PortFeedCheck.Repair, "repair-port-feeds", d.PortFeedCheck.Repair,
+		"Repair the stale marks of the port feeds found by the check.")
+	return f
+}
+
+func (f *Flags) apply(c *Config) {
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "metrics-bind-address":
+			c.Manager.MetricsBindAddress = f.values.Manager.MetricsBindAddress
+		case "health-probe-bind-address":
+			c.Manager.HealthProbeBindAddress = f.values.Manager.HealthProbeBindAddress
+		case "leader-elect":
+			c.Manager.LeaderElect = f.values.Manager.LeaderElect
+		case "store-backend":
+			c.Store.Backend = f.values.Store.Backend
+		case "bolt-path":
+			c.Store.BoltPath = f.values.Store.BoltPath
+		case "install-db-validators":
+			c.Store.InstallValidators = f.values.Store.InstallValidators
+		case "migration-dry-run":
+			c.Store.MigrationDryRun = f.values.Store.MigrationDryRun
+		case "agent-insecure":
+			c.Agent.Insecure = f.values.Agent.Insecure
+		case "port-feed-check-period":
+			c.PortFeedCheck.Period = f.values.PortFeedCheck.Period
+		case "repair-port-feeds":
+			c.PortFeedCheck.Repair = f.values.PortFeedCheck.Repair
+		}
+	})
+}
+
+func applyEnv(c *Config) error {
+	if v, ok := os.LookupEnv(ENV_MODE); ok {
+		c.Mode = v
+	}
+	if v, ok := os.LookupEnv(ENV_STORE_BACKEND); ok {
+		c.Store.Backend = v
+	}
+	if v, ok := os.LookupEnv(ENV_BOLT_PATH); ok {
+		c.Store.BoltPath = v
+	}
+	if v, ok := os.LookupEnv(ENV_AGENT_PORT); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", ENV_AGENT_PORT, err)
+		}
+		c.Agent.Port = port
+	}
+	if v, ok := os.LookupEnv(ENV_MAX_CONCURRENT_RECONCILES); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", ENV_MAX_CONCURRENT_RECONCILES, err)
+		}
+		c.Controller.MaxConcurrentReconciles = n
+	}
+	return nil
+}
+
+// Load reads the configuration from path on top of the defaults, applies the overrides
+// of the environment and of flags, and validates the result. An empty path only applies
+// the overrides to the defaults.
+func Load(path string, flags *Flags) (*Config, error) {
+	c := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+		}
+	}
+	if err := applyEnv(c); err != nil {
+		return nil, err
+	}
+	if flags != nil {
+		flags.apply(c)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
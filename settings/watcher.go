@@ -0,0 +1,95 @@
+package settings
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-logr/logr"
+)
+
+// Holder keeps the current configuration for the components which apply it live.
+type Holder struct {
+	cur atomic.Pointer[Config]
+}
+
+func NewHolder(c *Config) *Holder {
+	h := &Holder{}
+	h.cur.Store(c)
+	return h
+}
+
+func (h *Holder) Get() *Config {
+	return h.cur.Load()
+}
+
+// Watcher reloads the configuration file whenever it changes. An invalid file is reported
+// and ignored, so the last valid configuration stays in effect.
+type Watcher struct {
+	Path   string
+	Flags  *Flags
+	Holder *Holder
+	Logger logr.Logger
+	// OnChange is called after the configuration has been reloaded
+	OnChange func(old *Config, new *Config)
+}
+
+func (w *Watcher) Start(ctx context.Context) error {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fw.Close()
+	// watch the directory since a mounted ConfigMap replaces the file through a symlink
+	if err := fw.Add(filepath.Dir(w.Path)); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-fw.Errors:
+			w.Logger.Error(err, "error while watching the config file")
+		case <-fw.Events:
+			w.reload()
+		}
+	}
+}
+
+// NeedLeaderElection makes every replica reload its configuration.
+func (w *Watcher) NeedLeaderElection() bool {
+	return false
+}
+
+func (w *Watcher) reload() {
+	c, err := Load(w.Path, w.Flags)
+	if err != nil {
+		w.Logger.Error(err, "unable to reload the config; keep the current one")
+		return
+	}
+	old := w.Holder.Get()
+	if reflect.DeepEqual(old, c) {
+		return
+	}
+	if restartRequired(old, c) {
+		w.Logger.Info("some of the changed settings only take effect after a restart")
+	}
+	w.Holder.cur.Store(c)
+	w.Logger.Info("the config has been reloaded")
+	if w.OnChange != nil {
+		w.OnChange(old, c)
+	}
+}
+
+// restartRequired reports whether settings other than the ones applied live have changed.
+func restartRequired(old *Config, new *Config) bool {
+	o := *old
+	o.Store.ReadTimeout = new.Store.ReadTimeout
+	o.Store.WriteTimeout = new.Store.WriteTimeout
+	o.Agent.Port = new.Agent.Port
+	o.Agent.Discovery.Port = new.Agent.Discovery.Port
+	o.Deletion = new.Deletion
+	return !reflect.DeepEqual(&o, new)
+}
@@ -0,0 +1,416 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	MEMBER_LABEL = "networking.sealos.io/syncer-member"
+	SHARD_LABEL  = "networking.sealos.io/syncer-shard"
+	leasePrefix  = "sealos-nm-syncer"
+)
+
+//+kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update;patch;delete
+
+// Coordinator splits the work between the replicas of the synchronizer. The keys are
+// hashed into a fixed number of shards and every shard is guarded by a Lease, so a shard
+// is owned by at most one replica at any time. Each replica also keeps a membership Lease
+// alive; the replicas use the number of live members to take a fair share of the shards,
+// releasing extra shards when replicas join and taking over orphaned ones when they leave.
+type Coordinator struct {
+	// writes the leases
+	Client client.Client
+	// reads the leases from the API server without caching them
+	Reader        client.Reader
+	Namespace     string
+	Identity      string
+	Shards        int
+	LeaseDuration time.Duration
+	RenewPeriod   time.Duration
+	Logger        logr.Logger
+
+	mu sync.RWMutex
+	// the shards owned by this replica and when the ownership ends unless renewed
+	owned map[int]time.Time
+	// the work in flight per shard, which a shard waits for before it's handed back
+	inflight map[int]*sync.WaitGroup
+	acquired chan struct{}
+}
+
+// Start keeps the membership and the shards of this replica until the context is done,
+// then releases them so the other replicas can take over at once.
+func (c *Coordinator) Start(ctx context.Context) error {
+	c.init()
+	ticker := time.NewTicker(c.RenewPeriod)
+	defer ticker.Stop()
+	for {
+		if err := c.sync(ctx); err != nil {
+			c.Logger.Error(err, "failed to coordinate the shards")
+		}
+		select {
+		case <-ctx.Done():
+			c.releaseAll()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection makes every replica take part in the sharding.
+func (c *Coordinator) NeedLeaderElection() bool {
+	return false
+}
+
+// Owns reports whether this replica may work on key right now. The ownership is given up
+// a third of the lease duration before the lease expires, so that the work in flight is
+// done before another replica can take over the shard.
+func (c *Coordinator) Owns(key string) bool {
+	c.init()
+	shard := c.ShardOf(key)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	until, ok := c.owned[shard]
+	return ok && time.Now().Before(until.Add(-c.LeaseDuration/3))
+}
+
+// Acquire is Owns for a piece of work on key: if this replica owns key, the shard isn't
+// handed back before done is called, so done must be called once the work has finished.
+func (c *Coordinator) Acquire(key string) (done func(), ok bool) {
+	c.init()
+	shard := c.ShardOf(key)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	until, ok := c.owned[shard]
+	if !ok || !time.Now().Before(until.Add(-c.LeaseDuration/3)) {
+		return nil, false
+	}
+	// added under the lock, so that drop leaves no work to start after it
+	wg := c.inflight[shard]
+	wg.Add(1)
+	return wg.Done, true
+}
+
+// ShardOf returns the shard key belongs to.
+func (c *Coordinator) ShardOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(c.Shards))
+}
+
+// Acquired is notified whenever this replica has taken over shards, so the work of the
+// shards can be picked up without waiting for it to be requeued.
+func (c *Coordinator) Acquired() <-chan struct{} {
+	c.init()
+	return c.acquired
+}
+
+func (c *Coordinator) init() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.owned == nil {
+		c.owned = make(map[int]time.Time)
+		c.inflight = make(map[int]*sync.WaitGroup)
+		c.acquired = make(chan struct{}, 1)
+	}
+}
+
+func (c *Coordinator) sync(ctx context.Context) error {
+	if err := c.renewMembership(ctx); err != nil {
+		return err
+	}
+	members, err := c.liveMembers(ctx)
+	if err != nil {
+		return err
+	}
+	quota := (c.Shards + members - 1) / members
+
+	var leases coordinationv1.LeaseList
+	if err := c.Reader.List(ctx, &leases, client.InNamespace(c.Namespace), client.HasLabels{SHARD_LABEL}); err != nil {
+		return err
+	}
+	byShard := make(map[int]*coordinationv1.Lease)
+	for i := range leases.Items {
+		if shard, err := strconv.Atoi(leases.Items[i].Labels[SHARD_LABEL]); err == nil {
+			byShard[shard] = &leases.Items[i]
+		}
+	}
+
+	// renew the shards we hold and drop the ones we lost
+	var held []int
+	for shard := 0; shard < c.Shards; shard++ {
+		if !c.holds(shard) {
+			continue
+		}
+		lease := byShard[shard]
+		if lease == nil || pointer.StringDeref(lease.Spec.HolderIdentity, "") != c.Identity {
+			c.drop(shard)
+			continue
+		}
+		if err := c.renewShard(ctx, shard, lease); err != nil {
+			c.drop(shard)
+			c.Logger.Error(err, "lost the shard", "shard", shard)
+			continue
+		}
+		held = append(held, shard)
+	}
+
+	// give up the shards above our share so that new members can take them
+	for len(held) > quota {
+		shard := held[len(held)-1]
+		held = held[:len(held)-1]
+		c.release(ctx, shard, byShard[shard])
+	}
+
+	// take over free shards up to our share, preferring the ones hashed to us
+	newlyAcquired := false
+	for _, shard := range c.preferredOrder() {
+		if len(held) >= quota {
+			break
+		}
+		if c.holds(shard) {
+			continue
+		}
+		lease := byShard[shard]
+		if lease != nil && !leaseExpired(lease) {
+			continue
+		}
+		if err := c.acquireShard(ctx, shard, lease); err != nil {
+			if !apierrors.IsConflict(err) && !apierrors.IsAlreadyExists(err) {
+				c.Logger.Error(err, "failed to acquire the shard", "shard", shard)
+			}
+			continue
+		}
+		held = append(held, shard)
+		newlyAcquired = true
+	}
+	if newlyAcquired {
+		select {
+		case c.acquired <- struct{}{}:
+		default:
+		}
+	}
+	c.Logger.V(1).Info("the shards have been coordinated", "members", members, "quota", quota, "held", held)
+	return nil
+}
+
+func (c *Coordinator) holds(shard int) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.owned[shard]
+	return ok
+}
+
+func (c *Coordinator) hold(shard int, renewTime time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.owned[shard] = renewTime.Add(c.LeaseDuration)
+	if c.inflight[shard] == nil {
+		c.inflight[shard] = &sync.WaitGroup{}
+	}
+}
+
+func (c *Coordinator) drop(shard int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.owned, shard)
+}
+
+// preferredOrder sorts the shards by their rendezvous hash with this replica, so that the
+// replicas try different shards first and the assignment stays stable.
+func (c *Coordinator) preferredOrder() []int {
+	shards := make([]int, c.Shards)
+	weights := make([]uint32, c.Shards)
+	for i := range shards {
+		shards[i] = i
+		h := fnv.New32a()
+		h.Write([]byte(fmt.Sprintf("%s/%d", c.Identity, i)))
+		weights[i] = h.Sum32()
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		return weights[shards[i]] > weights[shards[j]]
+	})
+	return shards
+}
+
+func (c *Coordinator) renewMembership(ctx context.Context) error {
+	name := fmt.Sprintf("%s-member-%s", leasePrefix, c.Identity)
+	var lease coordinationv1.Lease
+	err := c.Reader.Get(ctx, client.ObjectKey{Namespace: c.Namespace, Name: name}, &lease)
+	if apierrors.IsNotFound(err) {
+		lease = coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: c.Namespace,
+				Name:      name,
+				Labels:    map[string]string{MEMBER_LABEL: "true"},
+			},
+		}
+		c.fillLease(&lease)
+		return c.Client.Create(ctx, &lease)
+	} else if err != nil {
+		return err
+	}
+	c.fillLease(&lease)
+	return c.Client.Update(ctx, &lease)
+}
+
+func (c *Coordinator) liveMembers(ctx context.Context) (int, error) {
+	var leases coordinationv1.LeaseList
+	if err := c.Reader.List(ctx, &leases, client.InNamespace(c.Namespace), client.HasLabels{MEMBER_LABEL}); err != nil {
+		return 0, err
+	}
+	members := 0
+	for i := range leases.Items {
+		if !leaseExpired(&leases.Items[i]) {
+			members++
+		}
+	}
+	if members == 0 {
+		// we have just renewed our own membership
+		members = 1
+	}
+	return members, nil
+}
+
+func (c *Coordinator) acquireShard(ctx context.Context, shard int, lease *coordinationv1.Lease) error {
+	if lease == nil {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: c.Namespace,
+				Name:      fmt.Sprintf("%s-shard-%d", leasePrefix, shard),
+				Labels:    map[string]string{SHARD_LABEL: strconv.Itoa(shard)},
+			},
+		}
+		c.fillLease(lease)
+		if err := c.Client.Create(ctx, lease); err != nil {
+			return err
+		}
+	} else {
+		// the update fails with a conflict if another replica has taken the shard meanwhile
+		c.fillLease(lease)
+		if err := c.Client.Update(ctx, lease); err != nil {
+			return err
+		}
+	}
+	c.hold(shard, lease.Spec.RenewTime.Time)
+	c.Logger.Info("acquired the shard", "shard", shard)
+	return nil
+}
+
+func (c *Coordinator) renewShard(ctx context.Context, shard int, lease *coordinationv1.Lease) error {
+	c.fillLease(lease)
+	if err := c.Client.Update(ctx, lease); err != nil {
+		return err
+	}
+	c.hold(shard, lease.Spec.RenewTime.Time)
+	return nil
+}
+
+// drain waits until the work in flight on the dropped shard has finished, or ctx is done.
+func (c *Coordinator) drain(ctx context.Context, shard int) bool {
+	c.mu.RLock()
+	wg := c.inflight[shard]
+	c.mu.RUnlock()
+	if wg == nil {
+		return true
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release stops taking new work on the shard and waits for the work in flight before
+// handing its lease back. If the work doesn't finish in time, the lease is left to expire
+// instead, by when the work has given up on the shard as well.
+func (c *Coordinator) release(ctx context.Context, shard int, lease *coordinationv1.Lease) {
+	c.drop(shard)
+	if lease == nil {
+		return
+	}
+	drainCtx, cancel := context.WithTimeout(ctx, c.RenewPeriod)
+	defer cancel()
+	if !c.drain(drainCtx, shard) {
+		c.Logger.Info("the work on the shard hasn't finished; let its lease expire", "shard", shard)
+		return
+	}
+	lease.Spec.HolderIdentity = nil
+	if err := c.Client.Update(ctx, lease); err != nil {
+		// the lease will expire anyway
+		c.Logger.Error(err, "failed to release the shard", "shard", shard)
+		return
+	}
+	c.Logger.Info("released the shard", "shard", shard)
+}
+
+func (c *Coordinator) releaseAll() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.RenewPeriod)
+	defer cancel()
+	var leases coordinationv1.LeaseList
+	if err := c.Reader.List(ctx, &leases, client.InNamespace(c.Namespace), client.HasLabels{SHARD_LABEL}); err != nil {
+		c.Logger.Error(err, "failed to release the shards")
+		return
+	}
+	var held []int
+	byShard := make(map[int]*coordinationv1.Lease)
+	for i := range leases.Items {
+		lease := &leases.Items[i]
+		shard, err := strconv.Atoi(lease.Labels[SHARD_LABEL])
+		if err != nil || !c.holds(shard) {
+			continue
+		}
+		// stop taking work on all of them first, so that they drain at the same time
+		c.drop(shard)
+		held = append(held, shard)
+		byShard[shard] = lease
+	}
+	for _, shard := range held {
+		c.release(ctx, shard, byShard[shard])
+	}
+	member := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: c.Namespace,
+			Name:      fmt.Sprintf("%s-member-%s", leasePrefix, c.Identity),
+		},
+	}
+	if err := c.Client.Delete(ctx, member); client.IgnoreNotFound(err) != nil {
+		c.Logger.Error(err, "failed to leave the members")
+	}
+}
+
+func (c *Coordinator) fillLease(lease *coordinationv1.Lease) {
+	now := metav1.NewMicroTime(time.Now())
+	lease.Spec.HolderIdentity = pointer.String(c.Identity)
+	lease.Spec.LeaseDurationSeconds = pointer.Int32(int32(c.LeaseDuration.Seconds()))
+	lease.Spec.RenewTime = &now
+}
+
+func leaseExpired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" {
+		return true
+	}
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return time.Now().After(expiry)
+}
@@ -0,0 +1,206 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newCoordinators(t *testing.T, shards int, identities ...string) []*Coordinator {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := coordinationv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	var cs []*Coordinator
+	for _, id := range identities {
+		coordinator := &Coordinator{
+			Client:        c,
+			Reader:        c,
+			Namespace:     "default",
+			Identity:      id,
+			Shards:        shards,
+			LeaseDuration: time.Second * 30,
+			RenewPeriod:   time.Second * 10,
+			Logger:        logr.Discard(),
+		}
+		coordinator.init()
+		cs = append(cs, coordinator)
+	}
+	return cs
+}
+
+func heldShards(c *Coordinator) []int {
+	var held []int
+	for shard := 0; shard < c.Shards; shard++ {
+		if c.holds(shard) {
+			held = append(held, shard)
+		}
+	}
+	return held
+}
+
+func TestShardOf(t *testing.T) {
+	c := &Coordinator{Shards: 16}
+	seen := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("10.0.0.%d", i)
+		shard := c.ShardOf(key)
+		if shard < 0 || shard >= c.Shards {
+			t.Fatalf("ShardOf(%s) = %d; want it within [0, %d)", key, shard, c.Shards)
+		}
+		if c.ShardOf(key) != shard {
+			t.Fatalf("ShardOf(%s) isn't stable", key)
+		}
+		seen[shard] = true
+	}
+	if len(seen) != c.Shards {
+		t.Errorf("the keys fall into %d of %d shards", len(seen), c.Shards)
+	}
+}
+
+// A replica joining takes over its share of the shards once the others have released it,
+// and every key is owned by exactly one replica at any time.
+func TestCoordinatorSharesShards(t *testing.T) {
+	ctx := context.Background()
+	cs := newCoordinators(t, 8, "a", "b")
+	a, b := cs[0], cs[1]
+	assertOwnedOnce := func(step string) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("10.0.0.%d", i)
+			if a.Owns(key) && b.Owns(key) {
+				t.Fatalf("%s: %s is owned by both replicas", step, key)
+			}
+		}
+	}
+
+	if err := a.sync(ctx); err != nil {
+		t.Fatalf("unable to sync a: %v", err)
+	}
+	if held := heldShards(a); len(held) != 8 {
+		t.Fatalf("a holds the shards %v alone; want all of them", held)
+	}
+	// b joins, but the shards are still held by a
+	if err := b.sync(ctx); err != nil {
+		t.Fatalf("unable to sync b: %v", err)
+	}
+	if held := heldShards(b); len(held) != 0 {
+		t.Fatalf("b holds the shards %v held by a", held)
+	}
+	assertOwnedOnce("after b joined")
+	// a gives up the shards above its share
+	if err := a.sync(ctx); err != nil {
+		t.Fatalf("unable to sync a: %v", err)
+	}
+	if held := heldShards(a); len(held) != 4 {
+		t.Fatalf("a holds the shards %v; want 4 of them", held)
+	}
+	assertOwnedOnce("after a released")
+	if err := b.sync(ctx); err != nil {
+		t.Fatalf("unable to sync b: %v", err)
+	}
+	if held := heldShards(b); len(held) != 4 {
+		t.Fatalf("b holds the shards %v; want the other 4", held)
+	}
+	select {
+	case <-b.Acquired():
+	default:
+		t.Errorf("b hasn't been notified of the shards it acquired")
+	}
+	assertOwnedOnce("after b acquired")
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("10.0.0.%d", i)
+		if !a.Owns(key) && !b.Owns(key) {
+			t.Fatalf("%s is owned by none of the replicas", key)
+		}
+	}
+
+	// a leaves and b takes over all the shards
+	a.releaseAll()
+	if held := heldShards(a); len(held) != 0 {
+		t.Fatalf("a still holds the shards %v after leaving", held)
+	}
+	if err := b.sync(ctx); err != nil {
+		t.Fatalf("unable to sync b: %v", err)
+	}
+	if held := heldShards(b); len(held) != 8 {
+		t.Fatalf("b holds the shards %v after a left; want all of them", held)
+	}
+}
+
+// A shard whose lease is taken by another replica is dropped at the next sync.
+func TestCoordinatorDropsLostShards(t *testing.T) {
+	ctx := context.Background()
+	cs := newCoordinators(t, 2, "a")
+	a := cs[0]
+	if err := a.sync(ctx); err != nil {
+		t.Fatalf("unable to sync a: %v", err)
+	}
+	var leases coordinationv1.LeaseList
+	if err := a.Reader.List(ctx, &leases, client.HasLabels{SHARD_LABEL}); err != nil {
+		t.Fatal(err)
+	}
+	lease := &leases.Items[0]
+	other := "z"
+	lease.Spec.HolderIdentity = &other
+	if err := a.Client.Update(ctx, lease); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.sync(ctx); err != nil {
+		t.Fatalf("unable to sync a: %v", err)
+	}
+	if held := heldShards(a); len(held) != 1 {
+		t.Errorf("a holds the shards %v; want only the one it hasn't lost", held)
+	}
+}
+
+// A shard isn't handed back before the work acquired on it has finished, and no work is
+// acquired on it once it's being handed back.
+func TestCoordinatorDrainsReleasedShards(t *testing.T) {
+	ctx := context.Background()
+	cs := newCoordinators(t, 1, "a")
+	a := cs[0]
+	if err := a.sync(ctx); err != nil {
+		t.Fatalf("unable to sync a: %v", err)
+	}
+	done, ok := a.Acquire("10.0.0.1")
+	if !ok {
+		t.Fatalf("a can't acquire a key of its shard")
+	}
+	released := make(chan struct{})
+	go func() {
+		a.releaseAll()
+		close(released)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	select {
+	case <-released:
+		t.Fatalf("the shard has been handed back with work in flight")
+	default:
+	}
+	if _, ok := a.Acquire("10.0.0.2"); ok {
+		t.Errorf("a acquired a key of the shard it is handing back")
+	}
+	done()
+	select {
+	case <-released:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("the shard hasn't been handed back after the work finished")
+	}
+	var leases coordinationv1.LeaseList
+	if err := a.Reader.List(ctx, &leases, client.HasLabels{SHARD_LABEL}); err != nil {
+		t.Fatal(err)
+	}
+	if len(leases.Items) != 1 || !leaseExpired(&leases.Items[0]) {
+		t.Errorf("the lease of the shard hasn't been handed back")
+	}
+}
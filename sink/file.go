@@ -0,0 +1,99 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-logr/logr"
+)
+
+// File appends the events as newline-delimited JSON to a file. The file is rotated once
+// it exceeds MaxSize: path is renamed to path.1, path.1 to path.2 and so on, keeping at
+// most MaxBackups old files.
+type File struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+	Logger     logr.Logger
+
+	f *os.File
+}
+
+func (s *File) Name() string {
+	return "file"
+}
+
+func (s *File) Send(ctx context.Context, events []Event) error {
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	w := bufio.NewWriter(s.f)
+	if err := writeJSONLines(w, events); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if info, err := s.f.Stat(); err != nil {
+		return err
+	} else if s.MaxSize > 0 && info.Size() >= s.MaxSize {
+		// the events have been written already, so they aren't failed; the rotation is
+		// tried again after the next batch
+		if err := s.rotate(); err != nil {
+			s.Logger.Error(err, "unable to rotate the file", "path", s.Path)
+		}
+	}
+	return nil
+}
+
+func (s *File) open() error {
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	return nil
+}
+
+func (s *File) rotate() error {
+	err := s.f.Close()
+	s.f = nil
+	if err != nil {
+		return err
+	}
+	if s.MaxBackups < 1 {
+		return os.Remove(s.Path)
+	}
+	for i := s.MaxBackups - 1; i >= 1; i-- {
+		older := fmt.Sprintf("%s.%d", s.Path, i)
+		if err := os.Rename(older, fmt.Sprintf("%s.%d", s.Path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(s.Path, s.Path+".1")
+}
+
+func (s *File) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+func writeJSONLines(w io.Writer, events []Event) error {
+	enc := json.NewEncoder(w)
+	for i := range events {
+		if err := enc.Encode(&events[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
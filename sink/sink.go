@@ -0,0 +1,192 @@
+package sink
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// a delta applied to a pod traffic account
+	KIND_DELTA = "delta"
+	// a tag of a port feed rolled up from a pod traffic account
+	KIND_ROLLUP = "rollup"
+)
+
+var (
+	droppedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sealos_nm_syncer_sink_events_dropped_total",
+		Help: "Total number of usage events dropped because the queue of the sink was full",
+	}, []string{"sink"})
+	failedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sealos_nm_syncer_sink_events_failed_total",
+		Help: "Total number of usage events the sink failed to deliver",
+	}, []string{"sink"})
+	deliveredEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sealos_nm_syncer_sink_events_delivered_total",
+		Help: "Total number of usage events delivered by the sink",
+	}, []string{"sink"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(droppedEvents, failedEvents, deliveredEvents)
+}
+
+// Event is the usage reported to the sinks. Deltas carry the bytes accounted by one sync
+// of a pod traffic account; rollups carry the new totals of a tag of a port feed.
+type Event struct {
+	Kind           string    `json:"kind"`
+	Time           time.Time `json:"time"`
+	NamespacedName string    `json:"namespacedName"`
+	Address        string    `json:"address"`
+	Tag            string    `json:"tag"`
+	// for deltas
+	TSR         string `json:"tsr,omitempty"`
+	Direction   string `json:"direction,omitempty"`
+	OldMark     uint64 `json:"oldMark,omitempty"`
+	NewMark     uint64 `json:"newMark,omitempty"`
+	Delta       uint64 `json:"delta,omitempty"`
+	Epoch       string `json:"epoch,omitempty"`
+	Node        string `json:"node,omitempty"`
+	ReconcileID string `json:"reconcileID,omitempty"`
+	// for rollups
+	PortFeed  string `json:"portFeed,omitempty"`
+	SentBytes uint64 `json:"sentBytes,omitempty"`
+	Mark      uint64 `json:"mark,omitempty"`
+}
+
+// Sink delivers batches of events to a downstream system.
+type Sink interface {
+	Name() string
+	// Send delivers the events in order. The events are dropped if it fails, so it should
+	// retry by itself as long as it makes sense.
+	Send(ctx context.Context, events []Event) error
+	Close() error
+}
+
+// Dispatcher hands the events over to the sinks asynchronously. Every sink has its own
+// queue, so a slow sink delays neither the reconciles nor the other sinks; the events
+// are dropped when the queue of a sink is full.
+type Dispatcher struct {
+	Logger logr.Logger
+	// the number of events queued per sink
+	QueueSize int
+	// the most events sent to a sink at once, and how long an incomplete batch waits
+	BatchSize     int
+	FlushInterval time.Duration
+
+	queues []*queue
+	wg     sync.WaitGroup
+	// guards the queues against being closed while an event is published
+	mu     sync.RWMutex
+	closed bool
+}
+
+type queue struct {
+	sink   Sink
+	events chan Event
+}
+
+// Start starts delivering to the sinks until Close is called.
+func (d *Dispatcher) Start(sinks ...Sink) {
+	for _, s := range sinks {
+		q := &queue{sink: s, events: make(chan Event, d.QueueSize)}
+		d.queues = append(d.queues, q)
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.deliver(q)
+		}()
+	}
+}
+
+// Publish queues the event for every sink without blocking. It's a no-op on a nil dispatcher.
+func (d *Dispatcher) Publish(e Event) {
+	if d == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	for _, q := range d.queues {
+		select {
+		case q.events <- e:
+		default:
+			droppedEvents.WithLabelValues(q.sink.Name()).Inc()
+		}
+	}
+}
+
+// Close stops taking events, delivers the queued ones and closes the sinks. The events
+// still queued are dropped when ctx is done.
+func (d *Dispatcher) Close(ctx context.Context) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for _, q := range d.queues {
+			close(q.events)
+		}
+	}
+	d.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		d.Logger.Info("gave up delivering the queued usage events")
+	}
+}
+
+func (d *Dispatcher) deliver(q *queue) {
+	log := d.Logger.WithValues("sink", q.sink.Name())
+	defer func() {
+		if err := q.sink.Close(); err != nil {
+			log.Error(err, "failed to close the sink")
+		}
+	}()
+	ticker := time.NewTicker(d.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]Event, 0, d.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := q.sink.Send(context.Background(), batch); err != nil {
+			log.Error(err, "failed to deliver the usage events; drop them", "events", len(batch))
+			failedEvents.WithLabelValues(q.sink.Name()).Add(float64(len(batch)))
+		} else {
+			deliveredEvents.WithLabelValues(q.sink.Name()).Add(float64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case e, ok := <-q.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= d.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"os"
+)
+
+// Stdout writes the events as newline-delimited JSON to the standard output, e.g. to be
+// collected with the logs of the container.
+type Stdout struct{}
+
+func (s Stdout) Name() string {
+	return "stdout"
+}
+
+func (s Stdout) Send(ctx context.Context, events []Event) error {
+	w := bufio.NewWriter(os.Stdout)
+	if err := writeJSONLines(w, events); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (s Stdout) Close() error {
+	return nil
+}
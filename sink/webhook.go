@@ -0,0 +1,120 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// the hex encoded HMAC-SHA256 of "<timestamp>.<body>" keyed with the secret
+	SIGNATURE_HEADER = "X-NM-Signature"
+	// the unix time the request was signed at, so that receivers can reject replays
+	TIMESTAMP_HEADER = "X-NM-Timestamp"
+	// the same for every attempt to deliver a batch, so that receivers can drop duplicates
+	DELIVERY_HEADER = "X-NM-Delivery"
+)
+
+// Webhook posts the events in batches as JSON to an HTTP endpoint, retrying with backoff
+// on network errors, 429 and 5xx responses.
+type Webhook struct {
+	URL string
+	// the file holding the secret the requests are signed with; unsigned if empty. It's
+	// read for every batch, so a rotated secret is used at once
+	SecretFile string
+	MaxRetries int
+	Timeout    time.Duration
+	Client     *http.Client
+}
+
+type webhookPayload struct {
+	Events []Event `json:"events"`
+}
+
+func (w *Webhook) Name() string {
+	return "webhook"
+}
+
+func (w *Webhook) Send(ctx context.Context, events []Event) error {
+	body, err := json.Marshal(webhookPayload{Events: events})
+	if err != nil {
+		return err
+	}
+	var secret []byte
+	if w.SecretFile != "" {
+		data, err := os.ReadFile(w.SecretFile)
+		if err != nil {
+			return err
+		}
+		secret = []byte(strings.TrimSpace(string(data)))
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	delivery := hex.EncodeToString(id)
+
+	backoff := time.Millisecond * 500
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ctx, body, secret, delivery)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= w.MaxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post sends the body once and reports whether a failure is worth retrying.
+func (w *Webhook) post(ctx context.Context, body []byte, secret []byte, delivery string) (bool, error) {
+	postCtx, cancel := context.WithTimeout(ctx, w.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(postCtx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DELIVERY_HEADER, delivery)
+	if secret != nil {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(ts + "."))
+		mac.Write(body)
+		req.Header.Set(TIMESTAMP_HEADER, ts)
+		req.Header.Set(SIGNATURE_HEADER, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("the webhook responded with %s", resp.Status)
+}
+
+func (w *Webhook) Close() error {
+	w.Client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	BACKEND_MONGO = "mongo"
+	BACKEND_BOLT  = "bolt"
+)
+
+// Backend persists the pod traffic accounts, the port feeds, the sync ledger, the usage
+// of the namespaces and the lost accountings.
+// Store keeps them in MongoDB and BoltStore in an embedded file; both have the same semantics.
+type Backend interface {
+	Launch(ctx context.Context) error
+	Close(ctx context.Context)
+	// Ready reports whether the backend has been launched successfully.
+	Ready(req *http.Request) error
+
+	FindPTA(ctx context.Context, nn string, pta *PodTrafficAccount) (bool, error)
+	FindPF(ctx context.Context, pf_id string, pf *PortFeed) (bool, error)
+	ApplyDelta(ctx context.Context, req TagPropReq, entry LedgerEntry) error
+	UpdatePortFeed(ctx context.Context, req PortFeedProp, updates []PortFeedUpdate) error
+	CompareAndSetPortFeed(ctx context.Context, req PortFeedProp, addressID string, tag string, old TagProperty, tp TagProperty) (bool, error)
+	Save(ctx context.Context, key string, pta *PodTrafficAccount) error
+	RecomputePTA(ctx context.Context, nn string, pta *PodTrafficAccount) error
+	RebuildPTA(ctx context.Context, nn string) error
+	FindNamespaceUsage(ctx context.Context, namespace string, period string, usage *NamespaceUsage) (bool, error)
+	RecordLostAccounting(ctx context.Context, lost LostAccounting) error
+	// ListPTAs and ListPFs return a page of the documents selected by opts and the cursor
+	// of the next one; see WalkPTAs and WalkPFs to visit all of them
+	ListPTAs(ctx context.Context, opts ListOptions) ([]PodTrafficAccount, string, error)
+	ListPFs(ctx context.Context, opts ListOptions) ([]PortFeed, string, error)
+}
+
+var _ Backend = &Store{}
+var _ Backend = &BoltStore{}
+
+const (
+	LAUNCH_RETRY_BASE = time.Second * 2
+	LAUNCH_RETRY_MAX  = time.Minute
+)
+
+// KeepLaunching launches the backend, retrying with backoff until it succeeds or ctx is
+// done, so that the synchronizer gets ready once the database is reachable again.
+func KeepLaunching(ctx context.Context, b Backend, log logr.Logger) error {
+	backoff := LAUNCH_RETRY_BASE
+	for {
+		err := b.Launch(ctx)
+		if err == nil {
+			return nil
+		}
+		log.Error(err, "unable to launch the store; retrying", "in", backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > LAUNCH_RETRY_MAX {
+			backoff = LAUNCH_RETRY_MAX
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// BoltStore keeps the data in an embedded bbolt file, e.g. on a PVC, for installs without an
+// external database. The file can only be opened by one synchronizer at a time.
+//
+// Each collection of Store is a bucket keyed by the primary key of its documents, which are
+// encoded in BSON. The ledger and the lost accountings have a nested bucket per pod traffic
+// account keyed by sequence.
+type BoltStore struct {
+	Path string
+	Log  *logr.Logger
+	// prices the traffic rolled up into the usage of the namespaces; free if nil
+	Pricer Pricer
+	db     atomic.Pointer[bolt.DB]
+	// the error of the last launch; nil once the store is ready
+	mu        sync.Mutex
+	launchErr error
+}
+
+func (s *BoltStore) Launch(ctx context.Context) error {
+	err := s.launch(ctx)
+	s.mu.Lock()
+	s.launchErr = err
+	s.mu.Unlock()
+	return err
+}
+
+func (s *BoltStore) launch(ctx context.Context) error {
+	if s.Path == "" || s.Log == nil {
+		return fmt.Errorf("the path and the logger shouldn't be empty")
+	}
+	if s.db.Load() != nil {
+		return nil
+	}
+	// the file is locked while it's open; don't wait forever if another process holds it
+	db, err := bolt.Open(s.Path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{PTA_COLL, PF_COLL, LEDGER_COLL, NS_USAGE_COLL, LOST_COLL} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	s.db.Store(db)
+	return nil
+}
+
+func (s *BoltStore) Ready(_ *http.Request) error {
+	if s.db.Load() != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.launchErr == nil {
+		return fmt.Errorf("the store has not been launched yet")
+	}
+	return s.launchErr
+}
+
+func (s *BoltStore) Close(ctx context.Context) {
+	if db := s.db.Load(); db != nil {
+		db.Close()
+	}
+}
+
+func (s *BoltStore) FindPTA(ctx context.Context, nn string, pta *PodTrafficAccount) (bool, error) {
+	if pta == nil {
+		return false, fmt.Errorf("the pta cannot be nil")
+	}
+	if s.db.Load() == nil {
+		return false, fmt.Errorf("please call Launch first")
+	}
+	var found bool
+	err := s.db.Load().View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = getDoc(tx, PTA_COLL, nn, pta)
+		return err
+	})
+	return found, err
+}
+
+func (s *BoltStore) FindPF(ctx context.Context, pf_id string, pf *PortFeed) (bool, error) {
+	if pf == nil {
+		return false, fmt.Errorf("the pf cannot be nil")
+	}
+	if s.db.Load() == nil {
+		return false, fmt.Errorf("please call Launch first")
+	}
+	var found bool
+	err := s.db.Load().View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = getDoc(tx, PF_COLL, pf_id, pf)
+		return err
+	})
+	return found, err
+}
+
+// ApplyDelta updates the account and appends the entry to the ledger in one transaction.
+func (s *BoltStore) ApplyDelta(ctx context.Context, req TagPropReq, entry LedgerEntry) error {
+	log := s.Log
+	if log == nil {
+		return nil
+	}
+	if s.db.Load() == nil {
+		return fmt.Errorf("please call Launch first")
+	}
+	if _, _, err := fieldsOfDirection(entry.Direction); err != nil {
+		return err
+	}
+	if err := prepareLedgerEntry(req, &entry); err != nil {
+		return err
+	}
+	err := s.db.Load().Update(func(tx *bolt.Tx) error {
+		var pta PodTrafficAccount
+		if found, err := getDoc(tx, PTA_COLL, req.NamespacedName, &pta); err != nil {
+			return err
+		} else if !found {
+			pta = PodTrafficAccount{
+				NamespacedName: req.NamespacedName,
+				SchemaVersion:  CURRENT_SCHEMA_VERSION,
+			}
+		}
+		tp := pta.AddressProperties[entry.AddressID].TagProperties[entry.Tag]
+		if tp.markOf(entry.Direction) != entry.StoredMark {
+			return ErrMarkConflict
+		}
+		pta.applyLedgerEntry(entry)
+		pta.UpdatedAt = entry.Timestamp
+		if req.Labels != nil {
+			pta.Labels = req.Labels
+		}
+		if err := putDoc(tx, PTA_COLL, req.NamespacedName, &pta); err != nil {
+			return err
+		}
+		if err := s.accrueUsage(tx, &entry); err != nil {
+			return err
+		}
+		return appendLedgerEntry(tx, entry)
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("the delta has been applied", "namespaced_name", req.NamespacedName, "addr", req.Addr, "tag", req.Tag, "direction", entry.Direction, "delta", entry.Delta, "cost_micros", entry.CostMicros)
+	return nil
+}
+
+func (s *BoltStore) Save(ctx context.Context, key string, pta *PodTrafficAccount) error {
+	if s.db.Load() == nil {
+		return fmt.Errorf("please call Launch first")
+	}
+	pta.SchemaVersion = CURRENT_SCHEMA_VERSION
+	pta.UpdatedAt = time.Now()
+	return s.db.Load().Update(func(tx *bolt.Tx) error {
+		return putDoc(tx, PTA_COLL, key, pta)
+	})
+}
+
+func (s *BoltStore) RecomputePTA(ctx context.Context, nn string, pta *PodTrafficAccount) error {
+	if pta == nil {
+		return fmt.Errorf("the pta cannot be nil")
+	}
+	if s.db.Load() == nil {
+		return fmt.Errorf("please call Launch first")
+	}
+	if err := resetPTA(nn, pta); err != nil {
+		return err
+	}
+	return s.db.Load().View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(LEDGER_COLL)).Bucket([]byte(nn))
+		if b == nil {
+			return nil
+		}
+		// the keys are sequences, so the entries are visited in the order they were applied
+		return b.ForEach(func(_, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var entry LedgerEntry
+			if err := bson.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			pta.applyLedgerEntry(entry)
+			return nil
+		})
+	})
+}
+
+func (s *BoltStore) RebuildPTA(ctx context.Context, nn string) error {
+	var pta, cur PodTrafficAccount
+	if err := s.RecomputePTA(ctx, nn, &pta); err != nil {
+		return err
+	}
+	if found, err := s.FindPTA(ctx, nn, &cur); err != nil {
+		return err
+	} else if found {
+		pta.Labels = cur.Labels
+	}
+	return s.Save(ctx, nn, &pta)
+}
+
+func getDoc(tx *bolt.Tx, coll string, key string, doc interface{}) (bool, error) {
+	v := tx.Bucket([]byte(coll)).Get([]byte(key))
+	if v == nil {
+		return false, nil
+	}
+	if err := bson.Unmarshal(v, doc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func putDoc(tx *bolt.Tx, coll string, key string, doc interface{}) error {
+	v, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(coll)).Put([]byte(key), v)
+}
+
+func appendLedgerEntry(tx *bolt.Tx, entry LedgerEntry) error {
+	b, err := tx.Bucket([]byte(LEDGER_COLL)).CreateBucketIfNotExists([]byte(entry.NamespacedName))
+	if err != nil {
+		return err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	v, err := bson.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return b.Put(key, v)
+}
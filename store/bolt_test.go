@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+)
+
+func newBoltStore(t *testing.T) *BoltStore {
+	t.Helper()
+	log := logr.Discard()
+	s := &BoltStore{Path: filepath.Join(t.TempDir(), "store.db"), Log: &log}
+	if err := s.Launch(context.Background()); err != nil {
+		t.Fatalf("unable to launch the store: %v", err)
+	}
+	t.Cleanup(func() { s.Close(context.Background()) })
+	return s
+}
+
+// The account is always what the ledger replays to, through counter resets as well.
+func TestBoltApplyDeltaMatchesLedger(t *testing.T) {
+	ctx := context.Background()
+	s := newBoltStore(t)
+	req := TagPropReq{NamespacedName: "default/web-0", Addr: "10.0.0.1", Tag: "public"}
+	entries := []LedgerEntry{
+		{Direction: DIRECTION_SENT, StoredMark: 0, OldMark: 0, NewMark: 100, Delta: 100, Epoch: "boot-1"},
+		{Direction: DIRECTION_RECV, StoredMark: 0, OldMark: 0, NewMark: 50, Delta: 50, Epoch: "boot-1"},
+		{Direction: DIRECTION_SENT, StoredMark: 100, OldMark: 100, NewMark: 250, Delta: 150, Epoch: "boot-1"},
+		// the agent has restarted, so its counter starts over below the stored mark
+		{Direction: DIRECTION_SENT, StoredMark: 250, OldMark: 0, NewMark: 30, Delta: 30, Epoch: "boot-2"},
+	}
+	for i, entry := range entries {
+		if err := s.ApplyDelta(ctx, req, entry); err != nil {
+			t.Fatalf("unable to apply entry %d: %v", i, err)
+		}
+	}
+	want := TagProperty{CurSentByteMark: 30, CurRecvByteMark: 50, SentBytes: 280, RecvBytes: 50, Epoch: "boot-2"}
+
+	var stored, replayed PodTrafficAccount
+	if found, err := s.FindPTA(ctx, req.NamespacedName, &stored); err != nil || !found {
+		t.Fatalf("unable to find the account: %v", err)
+	}
+	if err := s.RecomputePTA(ctx, req.NamespacedName, &replayed); err != nil {
+		t.Fatalf("unable to recompute the account: %v", err)
+	}
+	for name, pta := range map[string]*PodTrafficAccount{"stored": &stored, "replayed": &replayed} {
+		var tp TagProperty
+		if err := pta.GetTagProperty(req.Addr, req.Tag, false, &tp); err != nil {
+			t.Fatalf("unable to get the tag of the %s account: %v", name, err)
+		}
+		tp.Name = ""
+		if tp != want {
+			t.Errorf("the %s account has %+v; want %+v", name, tp, want)
+		}
+	}
+}
+
+// A delta computed from a mark which has moved since is refused and leaves no trace.
+func TestBoltApplyDeltaComparesMark(t *testing.T) {
+	ctx := context.Background()
+	s := newBoltStore(t)
+	req := TagPropReq{NamespacedName: "default/web-0", Addr: "10.0.0.1", Tag: "public"}
+	first := LedgerEntry{Direction: DIRECTION_SENT, NewMark: 100, Delta: 100}
+	if err := s.ApplyDelta(ctx, req, first); err != nil {
+		t.Fatalf("unable to apply the first delta: %v", err)
+	}
+	cases := []struct {
+		name  string
+		entry LedgerEntry
+	}{
+		// e.g. another replica read the same counter before the first delta was applied
+		{name: "the same delta again", entry: first},
+		{name: "a delta from a later mark", entry: LedgerEntry{Direction: DIRECTION_SENT, StoredMark: 120, OldMark: 120, NewMark: 130, Delta: 10}},
+	}
+	for _, c := range cases {
+		if err := s.ApplyDelta(ctx, req, c.entry); !errors.Is(err, ErrMarkConflict) {
+			t.Errorf("%s: ApplyDelta() = %v; want %v", c.name, err, ErrMarkConflict)
+		}
+	}
+	var replayed PodTrafficAccount
+	if err := s.RecomputePTA(ctx, req.NamespacedName, &replayed); err != nil {
+		t.Fatalf("unable to recompute the account: %v", err)
+	}
+	var tp TagProperty
+	if err := replayed.GetTagProperty(req.Addr, req.Tag, false, &tp); err != nil {
+		t.Fatalf("unable to get the tag: %v", err)
+	}
+	if tp.SentBytes != 100 || tp.CurSentByteMark != 100 {
+		t.Errorf("the ledger has %d bytes up to the mark %d; want 100 up to 100", tp.SentBytes, tp.CurSentByteMark)
+	}
+}
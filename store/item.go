@@ -1,11 +1,19 @@
 package store
 
+import "time"
+
+// the schema version of the documents written by this version of the synchronizer;
+// bump it together with a migration whenever the layout of the documents changes
+const CURRENT_SCHEMA_VERSION = 1
+
 type TagProperty struct {
 	Name            string `bson:"name"` // pk
 	CurSentByteMark uint64 `bson:"cur_sent_byte_mark"`
 	CurRecvByteMark uint64 `bson:"cur_recv_byte_mark"`
 	SentBytes       uint64 `bson:"sent_bytes"`
 	RecvBytes       uint64 `bson:"recv_bytes"`
+	// the epoch of the agent in which the byte marks were taken
+	Epoch string `bson:"epoch"`
 }
 type AddressProperty struct {
 	Address       string                 `bson:"address"` // pk
@@ -17,23 +25,33 @@ type PodTrafficAccount struct {
 	Name              string                     `bson:"name"`
 	Namespace         string                     `bson:"namespace"`
 	AddressProperties map[string]AddressProperty `bson:"address_properties"`
+	SchemaVersion     int                        `bson:"schema_version"`
+	// the labels of the traffic sync request as key=value pairs; see LabelPairs
+	Labels    []string  `bson:"labels,omitempty"`
+	UpdatedAt time.Time `bson:"updated_at,omitempty"`
 }
 
 type TagPropReq struct {
 	NamespacedName string
 	Addr           string
 	Tag            string
+	// replace the labels of the account if not nil
+	Labels []string
 }
 
 type PortFeedProp struct {
 	Namespace string `bson:"namespace"`
 	Pod       string `bson:"pod"`
+	// the labels of the port feed request as key=value pairs; see LabelPairs
+	Labels []string `bson:"labels,omitempty"`
 }
 
 type PortFeed struct {
 	ID                string                     `bson:"pf_id"`
 	Prop              PortFeedProp               `bson:"pf_prop"`
 	AddressProperties map[string]AddressProperty `bson:"address_properties"`
+	SchemaVersion     int                        `bson:"schema_version"`
+	UpdatedAt         time.Time                  `bson:"updated_at,omitempty"`
 }
 
 func (pta *PodTrafficAccount) GetByteMark(addr string, tag string, t int, isAddrEncoded bool, byteMark *uint64) error {
@@ -0,0 +1,296 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DIRECTION_SENT = "sent"
+	DIRECTION_RECV = "recv"
+)
+
+// LedgerEntry is an immutable record of a delta applied to a pod traffic account.
+// The totals of a pod traffic account are always the sum of its ledger entries.
+type LedgerEntry struct {
+	TSR            string    `bson:"tsr"`
+	NamespacedName string    `bson:"namespaced_name"`
+	Address        string    `bson:"address"`
+	AddressID      string    `bson:"address_id"`
+	Tag            string    `bson:"tag"`
+	Direction      string    `bson:"direction"`
+	OldMark        uint64    `bson:"old_mark"`
+	NewMark        uint64    `bson:"new_mark"`
+	Delta          uint64    `bson:"delta"`
+	Epoch          string    `bson:"epoch"`
+	Node           string    `bson:"node"`
+	Timestamp      time.Time `bson:"timestamp"`
+	ReconcileID    string    `bson:"reconcile_id"`
+	// the cost of the delta as priced when it was applied
+	CostMicros int64  `bson:"cost_micros"`
+	Currency   string `bson:"currency"`
+	// the mark stored when the delta was computed, which differs from OldMark if the
+	// counter has been reset since. The delta is only applied while it's still stored.
+	StoredMark uint64 `bson:"-"`
+}
+
+// ErrMarkConflict is returned by ApplyDelta if the mark has moved since the delta was
+// computed, e.g. by another replica syncing the same account; the delta has to be
+// computed again.
+var ErrMarkConflict = errors.New("the byte mark has moved since the delta was computed")
+
+func fieldsOfDirection(direction string) (bytesField string, markField string, err error) {
+	switch direction {
+	case DIRECTION_SENT:
+		return "sent_bytes", "cur_sent_byte_mark", nil
+	case DIRECTION_RECV:
+		return "recv_bytes", "cur_recv_byte_mark", nil
+	default:
+		return "", "", fmt.Errorf("unknown direction %s", direction)
+	}
+}
+
+// the error code of a command unknown to the server
+const COMMAND_NOT_FOUND = 59
+
+// requireTransactions fails unless the database is a replica set or a sharded cluster,
+// since a standalone server doesn't support the transactions of ApplyDelta.
+func (s *Store) requireTransactions(ctx context.Context) error {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	admin := s.dbClient.Database("admin")
+	res := admin.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}})
+	if cmdErr, ok := res.Err().(mongo.CommandError); ok && cmdErr.Code == COMMAND_NOT_FOUND {
+		// hello is only known to MongoDB 4.4.2 and later
+		res = admin.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}})
+	}
+	if err := res.Decode(&hello); err != nil {
+		return fmt.Errorf("unable to tell the topology of the database: %v", err)
+	}
+	if hello.SetName == "" && hello.Msg != "isdbgrid" {
+		return fmt.Errorf("the database is a standalone server; the ledger needs a replica set or a sharded cluster for transactions")
+	}
+	return nil
+}
+
+// ApplyDelta adds the delta of the entry to the pod traffic account, moves its byte mark,
+// rolls it up into the usage of the namespace and appends the entry to the ledger in one
+// transaction, so the totals never diverge from the ledger.
+func (s *Store) ApplyDelta(ctx context.Context, req TagPropReq, entry LedgerEntry) error {
+	log := s.Log
+	if log == nil {
+		return nil
+	}
+	if s.db.Load() == nil {
+		return fmt.Errorf("please call Launch first")
+	}
+	bytesField, markField, err := fieldsOfDirection(entry.Direction)
+	if err != nil {
+		return err
+	}
+	if err := prepareLedgerEntry(req, &entry); err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("address_properties.%s.tag_properties.%s", entry.AddressID, req.Tag)
+	set := bson.D{
+		{Key: prefix + "." + markField, Value: entry.NewMark},
+		{Key: "updated_at", Value: entry.Timestamp},
+	}
+	if entry.Epoch != "" {
+		set = append(set, bson.E{Key: prefix + ".epoch", Value: entry.Epoch})
+	}
+	if req.Labels != nil {
+		set = append(set, bson.E{Key: "labels", Value: req.Labels})
+	}
+	update := bson.D{
+		{Key: "$inc", Value: bson.D{{Key: prefix + "." + bytesField, Value: entry.Delta}}},
+		{Key: "$set", Value: set},
+		setOnInsertSchemaVersion,
+	}
+	// compare and set the mark; an account or tag which doesn't exist yet has no mark
+	var markFilter bson.E
+	if entry.StoredMark == 0 {
+		markFilter = bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: prefix + "." + markField, Value: uint64(0)}},
+			bson.D{{Key: prefix + "." + markField, Value: bson.D{{Key: "$exists", Value: false}}}},
+		}}
+	} else {
+		markFilter = bson.E{Key: prefix + "." + markField, Value: entry.StoredMark}
+	}
+	filter := bson.D{
+		{Key: "namespaced_name", Value: req.NamespacedName},
+		markFilter,
+	}
+
+	applyCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.writeTimeout())
+	defer cancel()
+	session, err := s.dbClient.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(applyCtx)
+	_, err = session.WithTransaction(applyCtx, func(sc mongo.SessionContext) (interface{}, error) {
+		// an account which exists but doesn't match makes the upsert violate the unique
+		// index; that is a moved mark as well
+		opts := options.Update().SetUpsert(entry.StoredMark == 0)
+		res, err := s.db.Load().Collection(PTA_COLL).UpdateOne(sc, filter, update, opts)
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrMarkConflict
+		} else if err != nil {
+			return nil, err
+		}
+		if res.MatchedCount == 0 && res.UpsertedCount == 0 {
+			return nil, ErrMarkConflict
+		}
+		if err := s.accrueUsage(sc, &entry); err != nil {
+			return nil, err
+		}
+		if _, err := s.db.Load().Collection(LEDGER_COLL).InsertOne(sc, entry); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("the delta has been applied", "namespaced_name", req.NamespacedName, "addr", req.Addr, "tag", req.Tag, "direction", entry.Direction, "delta", entry.Delta, "cost_micros", entry.CostMicros)
+	return nil
+}
+
+// RecomputePTA rebuilds the pod traffic account of nn from the ledger alone. The result
+// can be compared with the stored account to verify it, or saved to repair it.
+func (s *Store) RecomputePTA(ctx context.Context, nn string, pta *PodTrafficAccount) error {
+	if pta == nil {
+		return fmt.Errorf("the pta cannot be nil")
+	}
+	if s.db.Load() == nil {
+		return fmt.Errorf("please call Launch first")
+	}
+	coll := s.db.Load().Collection(LEDGER_COLL)
+	filter := bson.D{{
+		Key:   "namespaced_name",
+		Value: nn,
+	}}
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+	cur, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	if err := resetPTA(nn, pta); err != nil {
+		return err
+	}
+	for cur.Next(ctx) {
+		var entry LedgerEntry
+		if err := cur.Decode(&entry); err != nil {
+			return err
+		}
+		pta.applyLedgerEntry(entry)
+	}
+	return cur.Err()
+}
+
+// RebuildPTA replaces the stored pod traffic account of nn with the one recomputed from the ledger.
+// Traffic accounted before the ledger was introduced is not in the ledger and will be dropped.
+func (s *Store) RebuildPTA(ctx context.Context, nn string) error {
+	var pta, cur PodTrafficAccount
+	if err := s.RecomputePTA(ctx, nn, &pta); err != nil {
+		return err
+	}
+	// the labels aren't in the ledger
+	if found, err := s.FindPTA(ctx, nn, &cur); err != nil {
+		return err
+	} else if found {
+		pta.Labels = cur.Labels
+	}
+	return s.Save(ctx, nn, &pta)
+}
+
+// prepareLedgerEntry fills the entry with the account, address and tag it applies to.
+func prepareLedgerEntry(req TagPropReq, entry *LedgerEntry) error {
+	var id string
+	if err := encodeIP(req.Addr, &id); err != nil {
+		return err
+	}
+	addr, err := NormalizeIP(req.Addr)
+	if err != nil {
+		return err
+	}
+	entry.NamespacedName = req.NamespacedName
+	entry.Address = addr
+	entry.AddressID = id
+	entry.Tag = req.Tag
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	return nil
+}
+
+// resetPTA empties pta before it's recomputed from the ledger.
+func resetPTA(nn string, pta *PodTrafficAccount) error {
+	var nsName string
+	var podName string
+	if err := splitNamespacedName(nn, &nsName, &podName); err != nil {
+		return err
+	}
+	*pta = PodTrafficAccount{
+		NamespacedName:    nn,
+		Namespace:         nsName,
+		Name:              podName,
+		AddressProperties: make(map[string]AddressProperty),
+		SchemaVersion:     CURRENT_SCHEMA_VERSION,
+	}
+	return nil
+}
+
+// markOf returns the mark of the direction.
+func (tp TagProperty) markOf(direction string) uint64 {
+	if direction == DIRECTION_RECV {
+		return tp.CurRecvByteMark
+	}
+	return tp.CurSentByteMark
+}
+
+// applyLedgerEntry applies the entry to the account the same way ApplyDelta does.
+func (pta *PodTrafficAccount) applyLedgerEntry(entry LedgerEntry) {
+	if pta.AddressProperties == nil {
+		pta.AddressProperties = make(map[string]AddressProperty)
+	}
+	ap, ok := pta.AddressProperties[entry.AddressID]
+	if !ok || ap.TagProperties == nil {
+		ap.TagProperties = make(map[string]TagProperty)
+	}
+	tp := ap.TagProperties[entry.Tag]
+	switch entry.Direction {
+	case DIRECTION_SENT:
+		tp.SentBytes += entry.Delta
+		tp.CurSentByteMark = entry.NewMark
+	case DIRECTION_RECV:
+		tp.RecvBytes += entry.Delta
+		tp.CurRecvByteMark = entry.NewMark
+	}
+	if entry.Epoch != "" {
+		tp.Epoch = entry.Epoch
+	}
+	ap.TagProperties[entry.Tag] = tp
+	pta.AddressProperties[entry.AddressID] = ap
+}
+
+func splitNamespacedName(nn string, namespace *string, name *string) error {
+	if ns, n, found := strings.Cut(nn, "/"); found {
+		*namespace = ns
+		*name = n
+		return nil
+	}
+	return fmt.Errorf("%s is not a namespaced name", nn)
+}
@@ -0,0 +1,51 @@
+package store
+
+import "testing"
+
+func TestFieldsOfDirection(t *testing.T) {
+	cases := []struct {
+		direction  string
+		bytesField string
+		markField  string
+		fails      bool
+	}{
+		{direction: DIRECTION_SENT, bytesField: "sent_bytes", markField: "cur_sent_byte_mark"},
+		{direction: DIRECTION_RECV, bytesField: "recv_bytes", markField: "cur_recv_byte_mark"},
+		{direction: "both", fails: true},
+		{direction: "", fails: true},
+	}
+	for _, c := range cases {
+		bytesField, markField, err := fieldsOfDirection(c.direction)
+		if (err != nil) != c.fails {
+			t.Errorf("fieldsOfDirection(%q) failed with %v; want it to fail: %v", c.direction, err, c.fails)
+			continue
+		}
+		if bytesField != c.bytesField || markField != c.markField {
+			t.Errorf("fieldsOfDirection(%q) = %s, %s; want %s, %s", c.direction, bytesField, markField, c.bytesField, c.markField)
+		}
+	}
+}
+
+func TestSplitNamespacedName(t *testing.T) {
+	cases := []struct {
+		nn        string
+		namespace string
+		name      string
+		fails     bool
+	}{
+		{nn: "default/web-0", namespace: "default", name: "web-0"},
+		{nn: "/web-0", namespace: "", name: "web-0"},
+		{nn: "web-0", fails: true},
+	}
+	for _, c := range cases {
+		var namespace, name string
+		err := splitNamespacedName(c.nn, &namespace, &name)
+		if (err != nil) != c.fails {
+			t.Errorf("splitNamespacedName(%q) failed with %v; want it to fail: %v", c.nn, err, c.fails)
+			continue
+		}
+		if namespace != c.namespace || name != c.name {
+			t.Errorf("splitNamespacedName(%q) = %s, %s; want %s, %s", c.nn, namespace, name, c.namespace, c.name)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 100
+	MAX_PAGE_SIZE     = 1000
+)
+
+// ListOptions selects the documents listed and pages through them. The documents are
+// listed in the order of their primary keys; all the filters are combined.
+type ListOptions struct {
+	// the documents of the pods in the namespace
+	Namespace string
+	// the documents of the requests with all these labels
+	Labels map[string]string
+	// the documents updated at or after UpdatedSince; the documents written before the
+	// update time was recorded never match
+	UpdatedSince time.Time
+	// only these tags of every address are returned; all of them if empty
+	Tags []string
+	// the number of documents per page; DEFAULT_PAGE_SIZE if zero, at most MAX_PAGE_SIZE
+	Limit int
+	// the cursor returned with the previous page; empty for the first page
+	Continue string
+}
+
+// LabelPairs turns labels into the key=value pairs the documents are stored with, so that
+// the label keys, which may contain dots, can be queried. It never returns nil, so that
+// the labels removed from a request are removed from its documents as well.
+func LabelPairs(labels map[string]string) []string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+func (opts *ListOptions) limit() int {
+	switch {
+	case opts.Limit <= 0:
+		return DEFAULT_PAGE_SIZE
+	case opts.Limit > MAX_PAGE_SIZE:
+		return MAX_PAGE_SIZE
+	default:
+		return opts.Limit
+	}
+}
+
+// after returns the primary key the page starts after; empty for the first page.
+func (opts *ListOptions) after() (string, error) {
+	if opts.Continue == "" {
+		return "", nil
+	}
+	key, err := base64.RawURLEncoding.DecodeString(opts.Continue)
+	if err != nil || len(key) == 0 {
+		return "", fmt.Errorf("the continue token %q is invalid", opts.Continue)
+	}
+	return string(key), nil
+}
+
+func continueToken(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// matches reports whether a document with the primary key, labels and update time passes
+// the filters other than the cursor.
+func (opts *ListOptions) matches(key string, labels []string, updatedAt time.Time) bool {
+	if opts.Namespace != "" && !strings.HasPrefix(key, opts.Namespace+"/") {
+		return false
+	}
+	if !opts.UpdatedSince.IsZero() && updatedAt.Before(opts.UpdatedSince) {
+		return false
+	}
+	has := make(map[string]bool, len(labels))
+	for _, pair := range labels {
+		has[pair] = true
+	}
+	for _, pair := range LabelPairs(opts.Labels) {
+		if !has[pair] {
+			return false
+		}
+	}
+	return true
+}
+
+// pipeline returns the aggregation listing a page of the collection keyed by keyField,
+// whose label pairs are in labelsField. It fetches one document more than the page, which
+// tells whether there is another page.
+func (opts *ListOptions) pipeline(keyField string, labelsField string) (bson.A, error) {
+	after, err := opts.after()
+	if err != nil {
+		return nil, err
+	}
+	keyCond := bson.D{}
+	if after != "" {
+		keyCond = append(keyCond, bson.E{Key: "$gt", Value: after})
+	}
+	if opts.Namespace != "" {
+		// a prefix match can be answered from the index of the primary key
+		keyCond = append(keyCond, bson.E{Key: "$regex", Value: "^" + regexp.QuoteMeta(opts.Namespace+"/")})
+	}
+	match := bson.D{}
+	if len(keyCond) > 0 {
+		match = append(match, bson.E{Key: keyField, Value: keyCond})
+	}
+	if len(opts.Labels) > 0 {
+		match = append(match, bson.E{Key: labelsField, Value: bson.D{{Key: "$all", Value: LabelPairs(opts.Labels)}}})
+	}
+	if !opts.UpdatedSince.IsZero() {
+		match = append(match, bson.E{Key: "updated_at", Value: bson.D{{Key: "$gte", Value: opts.UpdatedSince}}})
+	}
+	pipeline := bson.A{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: keyField, Value: 1}}}},
+		bson.D{{Key: "$limit", Value: opts.limit() + 1}},
+	}
+	if len(opts.Tags) > 0 {
+		// the addresses and the tags are the keys of nested maps, which a projection can't
+		// select; filter the tag properties of every address instead
+		tagProperties := bson.D{{Key: "$arrayToObject", Value: bson.D{{Key: "$filter", Value: bson.D{
+			{Key: "input", Value: bson.D{{Key: "$objectToArray", Value: "$$ap.v.tag_properties"}}},
+			{Key: "as", Value: "tp"},
+			{Key: "cond", Value: bson.D{{Key: "$in", Value: bson.A{"$$tp.k", opts.Tags}}}},
+		}}}}}
+		addressProperties := bson.D{{Key: "$arrayToObject", Value: bson.D{{Key: "$map", Value: bson.D{
+			{Key: "input", Value: bson.D{{Key: "$objectToArray", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$address_properties", bson.D{}}}}}}},
+			{Key: "as", Value: "ap"},
+			{Key: "in", Value: bson.D{
+				{Key: "k", Value: "$$ap.k"},
+				{Key: "v", Value: bson.D{{Key: "$mergeObjects", Value: bson.A{"$$ap.v", bson.D{{Key: "tag_properties", Value: tagProperties}}}}}},
+			}},
+		}}}}}
+		pipeline = append(pipeline, bson.D{{Key: "$addFields", Value: bson.D{{Key: "address_properties", Value: addressProperties}}}})
+	}
+	return pipeline, nil
+}
+
+// projectTags drops the tags other than the selected ones from the address properties.
+func projectTags(aps map[string]AddressProperty, tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+	selected := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		selected[tag] = true
+	}
+	for _, ap := range aps {
+		for tag := range ap.TagProperties {
+			if !selected[tag] {
+				delete(ap.TagProperties, tag)
+			}
+		}
+	}
+}
+
+// ListPTAs returns a page of the pod traffic accounts selected by opts, and the cursor of
+// the next page; the cursor is empty after the last page.
+func (s *Store) ListPTAs(ctx context.Context, opts ListOptions) ([]PodTrafficAccount, string, error) {
+	if s.db.Load() == nil {
+		return nil, "", fmt.Errorf("please call Launch first")
+	}
+	pipeline, err := opts.pipeline("namespaced_name", "labels")
+	if err != nil {
+		return nil, "", err
+	}
+	listCtx, cancel := context.WithTimeout(ctx, s.readTimeout())
+	defer cancel()
+	cur, err := s.db.Load().Collection(PTA_COLL).Aggregate(listCtx, pipeline)
+	if err != nil {
+		return nil, "", err
+	}
+	var ptas []PodTrafficAccount
+	if err := cur.All(listCtx, &ptas); err != nil {
+		return nil, "", err
+	}
+	if len(ptas) > opts.limit() {
+		ptas = ptas[:opts.limit()]
+		return ptas, continueToken(ptas[len(ptas)-1].NamespacedName), nil
+	}
+	return ptas, "", nil
+}
+
+// ListPFs returns a page of the port feeds selected by opts, and the cursor of the next
+// page; the cursor is empty after the last page.
+func (s *Store) ListPFs(ctx context.Context, opts ListOptions) ([]PortFeed, string, error) {
+	if s.db.Load() == nil {
+		return nil, "", fmt.Errorf("please call Launch first")
+	}
+	pipeline, err := opts.pipeline("pf_id", "pf_prop.labels")
+	if err != nil {
+		return nil, "", err
+	}
+	listCtx, cancel := context.WithTimeout(ctx, s.readTimeout())
+	defer cancel()
+	cur, err := s.db.Load().Collection(PF_COLL).Aggregate(listCtx, pipeline)
+	if err != nil {
+		return nil, "", err
+	}
+	var pfs []PortFeed
+	if err := cur.All(listCtx, &pfs); err != nil {
+		return nil, "", err
+	}
+	if len(pfs) > opts.limit() {
+		pfs = pfs[:opts.limit()]
+		return pfs, continueToken(pfs[len(pfs)-1].ID), nil
+	}
+	return pfs, "", nil
+}
+
+func (s *BoltStore) ListPTAs(ctx context.Context, opts ListOptions) ([]PodTrafficAccount, string, error) {
+	if s.db.Load() == nil {
+		return nil, "", fmt.Errorf("please call Launch first")
+	}
+	var ptas []PodTrafficAccount
+	next, err := s.list(ctx, PTA_COLL, &opts, func(key string, v []byte) (bool, error) {
+		var pta PodTrafficAccount
+		if err := bson.Unmarshal(v, &pta); err != nil {
+			return false, err
+		}
+		if !opts.matches(key, pta.Labels, pta.UpdatedAt) {
+			return false, nil
+		}
+		projectTags(pta.AddressProperties, opts.Tags)
+		ptas = append(ptas, pta)
+		return true, nil
+	})
+	return ptas, next, err
+}
+
+func (s *BoltStore) ListPFs(ctx context.Context, opts ListOptions) ([]PortFeed, string, error) {
+	if s.db.Load() == nil {
+		return nil, "", fmt.Errorf("please call Launch first")
+	}
+	var pfs []PortFeed
+	next, err := s.list(ctx, PF_COLL, &opts, func(key string, v []byte) (bool, error) {
+		var pf PortFeed
+		if err := bson.Unmarshal(v, &pf); err != nil {
+			return false, err
+		}
+		if !opts.matches(key, pf.Prop.Labels, pf.UpdatedAt) {
+			return false, nil
+		}
+		projectTags(pf.AddressProperties, opts.Tags)
+		pfs = append(pfs, pf)
+		return true, nil
+	})
+	return pfs, next, err
+}
+
+// list visits the documents of the bucket coll in the order of their keys from the cursor
+// of opts, until visit has accepted a page of them. It returns the cursor of the next page.
+func (s *BoltStore) list(ctx context.Context, coll string, opts *ListOptions, visit func(key string, v []byte) (bool, error)) (string, error) {
+	after, err := opts.after()
+	if err != nil {
+		return "", err
+	}
+	var prefix []byte
+	if opts.Namespace != "" {
+		prefix = []byte(opts.Namespace + "/")
+	}
+	var next string
+	err = s.db.Load().View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(coll)).Cursor()
+		var k, v []byte
+		switch {
+		case after != "":
+			if k, v = c.Seek([]byte(after)); k != nil && string(k) == after {
+				k, v = c.Next()
+			}
+		case prefix != nil:
+			k, v = c.Seek(prefix)
+		default:
+			k, v = c.First()
+		}
+		accepted := 0
+		var last string
+		for ; k != nil; k, v = c.Next() {
+			if prefix != nil && !bytes.HasPrefix(k, prefix) {
+				if bytes.Compare(k, prefix) > 0 {
+					break
+				}
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if accepted == opts.limit() {
+				// there's at least one more document; it's checked on the next page
+				next = continueToken(last)
+				return nil
+			}
+			ok, err := visit(string(k), v)
+			if err != nil {
+				return err
+			}
+			if ok {
+				accepted++
+				last = string(k)
+			}
+		}
+		return nil
+	})
+	return next, err
+}
+
+// WalkPTAs calls fn with every pod traffic account selected by opts, fetching them page
+// by page from b. It stops at the first error of fn or when ctx is done.
+func WalkPTAs(ctx context.Context, b Backend, opts ListOptions, fn func(*PodTrafficAccount) error) error {
+	for {
+		ptas, next, err := b.ListPTAs(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for i := range ptas {
+			if err := fn(&ptas[i]); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		opts.Continue = next
+	}
+}
+
+// WalkPFs calls fn with every port feed selected by opts like WalkPTAs.
+func WalkPFs(ctx context.Context, b Backend, opts ListOptions, fn func(*PortFeed) error) error {
+	for {
+		pfs, next, err := b.ListPFs(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for i := range pfs {
+			if err := fn(&pfs[i]); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		opts.Continue = next
+	}
+}
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func savePTA(t *testing.T, s *BoltStore, nn string, labels map[string]string, tags ...string) {
+	t.Helper()
+	var namespace, name string
+	if err := splitNamespacedName(nn, &namespace, &name); err != nil {
+		t.Fatal(err)
+	}
+	tps := make(map[string]TagProperty)
+	for _, tag := range tags {
+		tps[tag] = TagProperty{Name: tag, SentBytes: 1}
+	}
+	pta := &PodTrafficAccount{
+		NamespacedName:    nn,
+		Namespace:         namespace,
+		Name:              name,
+		AddressProperties: map[string]AddressProperty{"a": {Address: "10.0.0.1", TagProperties: tps}},
+		Labels:            LabelPairs(labels),
+	}
+	if err := s.Save(context.Background(), nn, pta); err != nil {
+		t.Fatalf("unable to save %s: %v", nn, err)
+	}
+}
+
+func listedNames(ptas []PodTrafficAccount) []string {
+	names := make([]string, 0, len(ptas))
+	for _, pta := range ptas {
+		names = append(names, pta.NamespacedName)
+	}
+	return names
+}
+
+func TestBoltListPTAs(t *testing.T) {
+	ctx := context.Background()
+	s := newBoltStore(t)
+	savePTA(t, s, "a/web-0", map[string]string{"app": "web"}, "public", "private")
+	savePTA(t, s, "a/web-1", map[string]string{"app": "web"}, "public")
+	savePTA(t, s, "ab/db-0", map[string]string{"app": "db"}, "public")
+	savePTA(t, s, "b/web-0", map[string]string{"app": "web", "tier": "gold"}, "public")
+	since := time.Now()
+	time.Sleep(time.Millisecond * 10)
+	savePTA(t, s, "c/job-0", nil, "private")
+
+	cases := []struct {
+		name  string
+		opts  ListOptions
+		pages [][]string
+	}{
+		{
+			name:  "all in one page",
+			pages: [][]string{{"a/web-0", "a/web-1", "ab/db-0", "b/web-0", "c/job-0"}},
+		},
+		{
+			name:  "pages of two",
+			opts:  ListOptions{Limit: 2},
+			pages: [][]string{{"a/web-0", "a/web-1"}, {"ab/db-0", "b/web-0"}, {"c/job-0"}},
+		},
+		{
+			name:  "a page as large as the rest",
+			opts:  ListOptions{Limit: 5},
+			pages: [][]string{{"a/web-0", "a/web-1", "ab/db-0", "b/web-0", "c/job-0"}},
+		},
+		{
+			// a namespace is not a prefix of another one
+			name:  "a namespace",
+			opts:  ListOptions{Namespace: "a", Limit: 1},
+			pages: [][]string{{"a/web-0"}, {"a/web-1"}},
+		},
+		{
+			name:  "all the labels",
+			opts:  ListOptions{Labels: map[string]string{"app": "web", "tier": "gold"}},
+			pages: [][]string{{"b/web-0"}},
+		},
+		{
+			name:  "filtered pages",
+			opts:  ListOptions{Labels: map[string]string{"app": "web"}, Limit: 2},
+			pages: [][]string{{"a/web-0", "a/web-1"}, {"b/web-0"}},
+		},
+		{
+			name:  "updated since",
+			opts:  ListOptions{UpdatedSince: since},
+			pages: [][]string{{"c/job-0"}},
+		},
+		{
+			name:  "nothing",
+			opts:  ListOptions{Namespace: "d"},
+			pages: [][]string{nil},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := c.opts
+			for i, want := range c.pages {
+				ptas, next, err := s.ListPTAs(ctx, opts)
+				if err != nil {
+					t.Fatalf("unable to list page %d: %v", i, err)
+				}
+				if got := listedNames(ptas); !reflect.DeepEqual(got, want) && len(got)+len(want) > 0 {
+					t.Errorf("page %d has %v; want %v", i, got, want)
+				}
+				if last := i == len(c.pages)-1; last != (next == "") {
+					t.Fatalf("page %d has the cursor %q; want the last page to have none", i, next)
+				}
+				opts.Continue = next
+			}
+		})
+	}
+}
+
+func TestBoltListPTAsProjectsTags(t *testing.T) {
+	s := newBoltStore(t)
+	savePTA(t, s, "a/web-0", nil, "public", "private")
+	ptas, _, err := s.ListPTAs(context.Background(), ListOptions{Tags: []string{"private", "missing"}})
+	if err != nil {
+		t.Fatalf("unable to list: %v", err)
+	}
+	if len(ptas) != 1 {
+		t.Fatalf("listed %d accounts; want 1", len(ptas))
+	}
+	var tags []string
+	for tag := range ptas[0].AddressProperties["a"].TagProperties {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	if !reflect.DeepEqual(tags, []string{"private"}) {
+		t.Errorf("the account has the tags %v; want [private]", tags)
+	}
+}
+
+func TestBoltListRejectsInvalidCursor(t *testing.T) {
+	s := newBoltStore(t)
+	if _, _, err := s.ListPTAs(context.Background(), ListOptions{Continue: "!"}); err == nil {
+		t.Errorf("ListPTAs() with an invalid cursor succeeded")
+	}
+	if _, _, err := s.ListPFs(context.Background(), ListOptions{Continue: "!"}); err == nil {
+		t.Errorf("ListPFs() with an invalid cursor succeeded")
+	}
+}
+
+func TestWalkPTAs(t *testing.T) {
+	s := newBoltStore(t)
+	want := []string{"a/web-0", "a/web-1", "b/web-0"}
+	for _, nn := range want {
+		savePTA(t, s, nn, nil, "public")
+	}
+	var got []string
+	err := WalkPTAs(context.Background(), s, ListOptions{Limit: 1}, func(pta *PodTrafficAccount) error {
+		got = append(got, pta.NamespacedName)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to walk: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("walked %v; want %v", got, want)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	cases := []struct {
+		limit int
+		want  int
+	}{
+		{limit: 0, want: DEFAULT_PAGE_SIZE},
+		{limit: -1, want: DEFAULT_PAGE_SIZE},
+		{limit: 10, want: 10},
+		{limit: MAX_PAGE_SIZE + 1, want: MAX_PAGE_SIZE},
+	}
+	for _, c := range cases {
+		opts := ListOptions{Limit: c.limit}
+		if got := opts.limit(); got != c.want {
+			t.Errorf("the limit %d is %d; want %d", c.limit, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// LostAccounting records a window of the traffic of a tag which will never be accounted,
+// because its traffic sync request was released before the final sync succeeded, e.g.
+// after the node of the pod was removed. Unlike the ledger, it doesn't change any total.
+type LostAccounting struct {
+	TSR            string `bson:"tsr"`
+	NamespacedName string `bson:"namespaced_name"`
+	Address        string `bson:"address"`
+	Tag            string `bson:"tag"`
+	Node           string `bson:"node"`
+	// the last successful sync of the tag; zero if it has never been synchronized
+	Since time.Time `bson:"since"`
+	// when the request was released; the traffic between Since and Until is lost
+	Until time.Time `bson:"until"`
+	// why the request was released, and the error of the final sync
+	Reason    string `bson:"reason"`
+	LastError string `bson:"last_error"`
+}
+
+func (s *Store) RecordLostAccounting(ctx context.Context, lost LostAccounting) error {
+	log := s.Log
+	if log == nil {
+		return nil
+	}
+	if s.db.Load() == nil {
+		return fmt.Errorf("please call Launch first")
+	}
+	if lost.Until.IsZero() {
+		lost.Until = time.Now()
+	}
+	insertCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.writeTimeout())
+	defer cancel()
+	if _, err := s.db.Load().Collection(LOST_COLL).InsertOne(insertCtx, lost); err != nil {
+		return err
+	}
+	log.Info("the lost accounting has been recorded", "namespaced_name", lost.NamespacedName, "addr", lost.Address, "tag", lost.Tag, "since", lost.Since, "reason", lost.Reason)
+	return nil
+}
+
+func (s *BoltStore) RecordLostAccounting(ctx context.Context, lost LostAccounting) error {
+	log := s.Log
+	if log == nil {
+		return nil
+	}
+	if s.db.Load() == nil {
+		return fmt.Errorf("please call Launch first")
+	}
+	if lost.Until.IsZero() {
+		lost.Until = time.Now()
+	}
+	err := s.db.Load().Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket([]byte(LOST_COLL)).CreateBucketIfNotExists([]byte(lost.NamespacedName))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		v, err := bson.Marshal(lost)
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, v)
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("the lost accounting has been recorded", "namespaced_name", lost.NamespacedName, "addr", lost.Address, "tag", lost.Tag, "since", lost.Since, "reason", lost.Reason)
+	return nil
+}
@@ -0,0 +1,196 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	MIGRATION_COLL      = "schema_migrations"
+	MIGRATION_LOCK_COLL = "schema_migration_lock"
+	migrationLockID     = "schema"
+	migrationLockTTL    = time.Minute * 10
+	migrationLockPoll   = time.Second * 5
+)
+
+// Migration moves the stored documents from schema version Version-1 to Version.
+type Migration struct {
+	Version int
+	Name    string
+	// Up migrates the documents and returns how many of them have been (or, in dry-run mode,
+	// would have been) changed. It must be idempotent since it is re-run if the synchronizer
+	// is interrupted before the migration is recorded.
+	Up func(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error)
+}
+
+type appliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+	Changed   int64     `bson:"changed"`
+}
+
+type migrationLock struct {
+	ID        string    `bson:"_id"`
+	Holder    string    `bson:"holder"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+var migrations []Migration
+
+func registerMigration(m Migration) {
+	migrations = append(migrations, m)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+}
+
+func init() {
+	registerMigration(Migration{
+		Version: 1,
+		Name:    "add schema_version",
+		Up: func(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error) {
+			filter := bson.D{{Key: "schema_version", Value: bson.D{{Key: "$exists", Value: false}}}}
+			update := bson.D{{Key: "$set", Value: bson.D{{Key: "schema_version", Value: 1}}}}
+			var changed int64
+			for _, coll := range []string{PTA_COLL, PF_COLL} {
+				if dryRun {
+					n, err := db.Collection(coll).CountDocuments(ctx, filter)
+					if err != nil {
+						return changed, err
+					}
+					changed += n
+					continue
+				}
+				res, err := db.Collection(coll).UpdateMany(ctx, filter, update)
+				if err != nil {
+					return changed, err
+				}
+				changed += res.ModifiedCount
+			}
+			return changed, nil
+		},
+	})
+}
+
+// ErrMigrationDryRun is returned by Launch after the pending migrations have been reported
+// in dry-run mode. The store is left unusable, since the documents written by it would
+// carry the current schema version without having been migrated.
+var ErrMigrationDryRun = errors.New("the migrations have only been reported in dry-run mode")
+
+// migrate runs the registered migrations which have not been applied yet in the order of
+// their versions. Only one synchronizer migrates the database at a time; the others wait
+// for the lock and then find nothing left to do.
+func (s *Store) migrate(ctx context.Context) error {
+	holder, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	if err := s.acquireMigrationLock(ctx, holder); err != nil {
+		return err
+	}
+	defer s.releaseMigrationLock(holder)
+
+	applied := make(map[int]bool)
+	cur, err := s.conn.Collection(MIGRATION_COLL).Find(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	var records []appliedMigration
+	if err := cur.All(ctx, &records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		applied[r.Version] = true
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		log := s.Log.WithValues("version", m.Version, "migration", m.Name, "dry_run", s.MigrationDryRun)
+		log.Info("running the migration")
+		start := time.Now()
+		changed, err := m.Up(ctx, s.conn, s.MigrationDryRun)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed after changing %d documents: %v", m.Version, m.Name, changed, err)
+		}
+		log.Info("the migration has finished", "changed", changed, "duration", time.Since(start))
+		if s.MigrationDryRun {
+			continue
+		}
+		record := appliedMigration{
+			Version:   m.Version,
+			Name:      m.Name,
+			AppliedAt: time.Now(),
+			Changed:   changed,
+		}
+		if _, err := s.conn.Collection(MIGRATION_COLL).InsertOne(ctx, record); err != nil {
+			return err
+		}
+		if err := s.renewMigrationLock(ctx, holder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) acquireMigrationLock(ctx context.Context, holder string) error {
+	for {
+		err := s.renewMigrationLock(ctx, holder)
+		if err == nil {
+			return nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		// the lock is held by another synchronizer
+		s.Log.Info("waiting for the migration lock")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(migrationLockPoll):
+		}
+	}
+}
+
+// renewMigrationLock takes the lock if it's free, expired or already held by holder. It
+// fails with a duplicate key error if someone else holds the lock.
+func (s *Store) renewMigrationLock(ctx context.Context, holder string) error {
+	now := time.Now()
+	filter := bson.D{
+		{Key: "_id", Value: migrationLockID},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "holder", Value: holder}},
+			bson.D{{Key: "expires_at", Value: bson.D{{Key: "$lt", Value: now}}}},
+		}},
+	}
+	lock := migrationLock{
+		ID:        migrationLockID,
+		Holder:    holder,
+		ExpiresAt: now.Add(migrationLockTTL),
+	}
+	opts := options.Replace().SetUpsert(true)
+	_, err := s.conn.Collection(MIGRATION_LOCK_COLL).ReplaceOne(ctx, filter, lock, opts)
+	return err
+}
+
+func (s *Store) releaseMigrationLock(holder string) {
+	releaseCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	filter := bson.D{
+		{Key: "_id", Value: migrationLockID},
+		{Key: "holder", Value: holder},
+	}
+	if _, err := s.conn.Collection(MIGRATION_LOCK_COLL).DeleteOne(releaseCtx, filter); err != nil {
+		s.Log.Error(err, "unable to release the migration lock")
+	}
+}
@@ -0,0 +1,33 @@
+package store
+
+import "testing"
+
+// Every schema version up to the current one has exactly one migration, and they run in
+// the order of their versions.
+func TestMigrationsAreContiguous(t *testing.T) {
+	if len(migrations) != CURRENT_SCHEMA_VERSION {
+		t.Fatalf("there are %d migrations for the schema version %d", len(migrations), CURRENT_SCHEMA_VERSION)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d has the version %d; want %d", i, m.Version, i+1)
+		}
+		if m.Name == "" || m.Up == nil {
+			t.Errorf("migration %d has no name or no Up", m.Version)
+		}
+	}
+}
+
+func TestRegisterMigrationSortsByVersion(t *testing.T) {
+	saved := migrations
+	defer func() { migrations = saved }()
+	migrations = nil
+	for _, v := range []int{3, 1, 2} {
+		registerMigration(Migration{Version: v})
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d has the version %d; want %d", i, m.Version, i+1)
+		}
+	}
+}
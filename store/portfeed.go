@@ -0,0 +1,240 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PortFeedUpdate is the new tag property of an address of a port feed.
+type PortFeedUpdate struct {
+	// the encoded address, as the port feed and the pod traffic account are keyed by
+	AddressID string
+	Tag       string
+	TP        TagProperty
+}
+
+// PortFeedUpdateError reports the updates of a batch which haven't been applied; the
+// other updates of the batch have been.
+type PortFeedUpdateError struct {
+	PortFeed string
+	// the errors of the failed updates by their indexes in the batch
+	Failed map[int]error
+	// the updates of the batch, to name the failed ones
+	Updates []PortFeedUpdate
+}
+
+func (e *PortFeedUpdateError) Error() string {
+	indexes := make([]int, 0, len(e.Failed))
+	for i := range e.Failed {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	msgs := make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		u := e.Updates[i]
+		msgs = append(msgs, fmt.Sprintf("%s/%s: %v", u.AddressID, u.Tag, e.Failed[i]))
+	}
+	return fmt.Sprintf("%d of %d updates of the port feed %s failed: %s", len(e.Failed), len(e.Updates), e.PortFeed, strings.Join(msgs, "; "))
+}
+
+func (e *PortFeedUpdateError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, err := range e.Failed {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// UpdatePortFeed sets the tag properties of the port feed of req to the updates and its
+// prop to req in one bulk write. The updates are applied independently of each other; if
+// some of them fail, a *PortFeedUpdateError tells which.
+func (s *Store) UpdatePortFeed(ctx context.Context, req PortFeedProp, updates []PortFeedUpdate) error {
+	log := s.Log
+	if log == nil {
+		return nil
+	}
+	if s.db.Load() == nil {
+		return fmt.Errorf("please call Launch first")
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	pf_id := fmt.Sprintf("%s/%s", req.Namespace, req.Pod)
+	filter := bson.D{{
+		Key:   "pf_id",
+		Value: pf_id,
+	}}
+	models := make([]mongo.WriteModel, 0, len(updates))
+	for _, u := range updates {
+		key := fmt.Sprintf("address_properties.%s.tag_properties.%s", u.AddressID, u.Tag)
+		update := bson.D{
+			{
+				Key: "$set",
+				Value: bson.D{
+					{Key: key, Value: u.TP},
+					{Key: "pf_prop", Value: req},
+				},
+			},
+			{
+				Key: "$currentDate",
+				Value: bson.D{{
+					Key:   "updated_at",
+					Value: true,
+				}},
+			},
+			setOnInsertSchemaVersion,
+		}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
+	}
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.writeTimeout())
+	defer cancel()
+	// unordered, so that a failing update doesn't keep the rest of the batch from being applied
+	opts := options.BulkWrite().SetOrdered(false)
+	_, err := s.db.Load().Collection(PF_COLL).BulkWrite(writeCtx, models, opts)
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && bwe.WriteConcernError == nil && len(bwe.WriteErrors) > 0 {
+		ue := &PortFeedUpdateError{PortFeed: pf_id, Failed: make(map[int]error), Updates: updates}
+		for _, we := range bwe.WriteErrors {
+			ue.Failed[we.Index] = we
+		}
+		err = ue
+	}
+	if err != nil {
+		return err
+	}
+	log.Info("the data of the port feed has been updated", "pf_id", pf_id, "updates", len(updates))
+	return nil
+}
+
+// CompareAndSetPortFeed sets the tag property of an address of the port feed of req to tp
+// only if it's still old, and reports whether it was set. It's meant for the writes based
+// on a read which a rollup may have overtaken since.
+func (s *Store) CompareAndSetPortFeed(ctx context.Context, req PortFeedProp, addressID string, tag string, old TagProperty, tp TagProperty) (bool, error) {
+	log := s.Log
+	if log == nil {
+		return false, nil
+	}
+	if s.db.Load() == nil {
+		return false, fmt.Errorf("please call Launch first")
+	}
+	pf_id := fmt.Sprintf("%s/%s", req.Namespace, req.Pod)
+	key := fmt.Sprintf("address_properties.%s.tag_properties.%s", addressID, tag)
+	filter := bson.D{
+		{Key: "pf_id", Value: pf_id},
+		{Key: key + ".cur_sent_byte_mark", Value: old.CurSentByteMark},
+		{Key: key + ".sent_bytes", Value: old.SentBytes},
+	}
+	update := bson.D{
+		{
+			Key: "$set",
+			Value: bson.D{
+				{Key: key, Value: tp},
+				{Key: "pf_prop", Value: req},
+			},
+		},
+		{
+			Key: "$currentDate",
+			Value: bson.D{{
+				Key:   "updated_at",
+				Value: true,
+			}},
+		},
+	}
+	updateCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.writeTimeout())
+	defer cancel()
+	res, err := s.db.Load().Collection(PF_COLL).UpdateOne(updateCtx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount == 0 {
+		return false, nil
+	}
+	log.Info("the data of the port feed has been updated", "pf_id", pf_id, "addr", addressID, "tag", tag)
+	return true, nil
+}
+
+func (s *BoltStore) CompareAndSetPortFeed(ctx context.Context, req PortFeedProp, addressID string, tag string, old TagProperty, tp TagProperty) (bool, error) {
+	log := s.Log
+	if log == nil {
+		return false, nil
+	}
+	if s.db.Load() == nil {
+		return false, fmt.Errorf("please call Launch first")
+	}
+	pf_id := fmt.Sprintf("%s/%s", req.Namespace, req.Pod)
+	var set bool
+	err := s.db.Load().Update(func(tx *bolt.Tx) error {
+		var pf PortFeed
+		if found, err := getDoc(tx, PF_COLL, pf_id, &pf); err != nil || !found {
+			return err
+		}
+		cur, ok := pf.AddressProperties[addressID].TagProperties[tag]
+		if !ok || cur.CurSentByteMark != old.CurSentByteMark || cur.SentBytes != old.SentBytes {
+			return nil
+		}
+		pf.AddressProperties[addressID].TagProperties[tag] = tp
+		pf.Prop = req
+		pf.UpdatedAt = time.Now()
+		set = true
+		return putDoc(tx, PF_COLL, pf_id, &pf)
+	})
+	if err != nil || !set {
+		return false, err
+	}
+	log.Info("the data of the port feed has been updated", "pf_id", pf_id, "addr", addressID, "tag", tag)
+	return true, nil
+}
+
+// UpdatePortFeed applies the updates in one transaction; they're applied all or none.
+func (s *BoltStore) UpdatePortFeed(ctx context.Context, req PortFeedProp, updates []PortFeedUpdate) error {
+	log := s.Log
+	if log == nil {
+		return nil
+	}
+	if s.db.Load() == nil {
+		return fmt.Errorf("please call Launch first")
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	pf_id := fmt.Sprintf("%s/%s", req.Namespace, req.Pod)
+	err := s.db.Load().Update(func(tx *bolt.Tx) error {
+		var pf PortFeed
+		if found, err := getDoc(tx, PF_COLL, pf_id, &pf); err != nil {
+			return err
+		} else if !found {
+			pf = PortFeed{
+				ID:            pf_id,
+				SchemaVersion: CURRENT_SCHEMA_VERSION,
+			}
+		}
+		if pf.AddressProperties == nil {
+			pf.AddressProperties = make(map[string]AddressProperty)
+		}
+		for _, u := range updates {
+			ap := pf.AddressProperties[u.AddressID]
+			if ap.TagProperties == nil {
+				ap.TagProperties = make(map[string]TagProperty)
+			}
+			ap.TagProperties[u.Tag] = u.TP
+			pf.AddressProperties[u.AddressID] = ap
+		}
+		pf.Prop = req
+		pf.UpdatedAt = time.Now()
+		return putDoc(tx, PF_COLL, pf_id, &pf)
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("the data of the port feed has been updated", "pf_id", pf_id, "updates", len(updates))
+	return nil
+}
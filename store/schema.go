@@ -0,0 +1,266 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the error code mongodb returns when collMod is run on a collection that doesn't exist
+const namespaceNotFoundCode = 26
+
+var indexes = map[string][]mongo.IndexModel{
+	PTA_COLL: {
+		{
+			Keys:    bson.D{{Key: "namespaced_name", Value: 1}},
+			Options: options.Index().SetName("namespaced_name_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "updated_at", Value: 1}},
+			Options: options.Index().SetName("updated_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "labels", Value: 1}},
+			Options: options.Index().SetName("labels"),
+		},
+	},
+	PF_COLL: {
+		{
+			Keys:    bson.D{{Key: "pf_id", Value: 1}},
+			Options: options.Index().SetName("pf_id_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "updated_at", Value: 1}},
+			Options: options.Index().SetName("updated_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "pf_prop.labels", Value: 1}},
+			Options: options.Index().SetName("labels"),
+		},
+	},
+	LEDGER_COLL: {
+		{
+			Keys:    bson.D{{Key: "namespaced_name", Value: 1}, {Key: "timestamp", Value: 1}},
+			Options: options.Index().SetName("namespaced_name_timestamp"),
+		},
+	},
+	LOST_COLL: {
+		{
+			Keys:    bson.D{{Key: "namespaced_name", Value: 1}, {Key: "until", Value: 1}},
+			Options: options.Index().SetName("namespaced_name_until"),
+		},
+	},
+	NS_USAGE_COLL: {
+		{
+			Keys:    bson.D{{Key: "usage_id", Value: 1}},
+			Options: options.Index().SetName("usage_id_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "period", Value: 1}, {Key: "namespace", Value: 1}},
+			Options: options.Index().SetName("period_namespace"),
+		},
+	},
+}
+
+var tagPropertySchema = bson.M{
+	"bsonType": "object",
+	"properties": bson.M{
+		"cur_sent_byte_mark": bson.M{"bsonType": "long"},
+		"cur_recv_byte_mark": bson.M{"bsonType": "long"},
+		"sent_bytes":         bson.M{"bsonType": "long"},
+		"recv_bytes":         bson.M{"bsonType": "long"},
+		"epoch":              bson.M{"bsonType": "string"},
+	},
+}
+
+var addressPropertiesSchema = bson.M{
+	"bsonType": "object",
+	"additionalProperties": bson.M{
+		"bsonType": "object",
+		"properties": bson.M{
+			"tag_properties": bson.M{
+				"bsonType":             "object",
+				"additionalProperties": tagPropertySchema,
+			},
+		},
+	},
+}
+
+var schemaVersionSchema = bson.M{"bsonType": bson.A{"int", "long"}}
+
+var labelsSchema = bson.M{
+	"bsonType": "array",
+	"items":    bson.M{"bsonType": "string"},
+}
+
+var validators = map[string]bson.M{
+	PTA_COLL: {
+		"bsonType": "object",
+		"required": bson.A{"namespaced_name"},
+		"properties": bson.M{
+			"namespaced_name":    bson.M{"bsonType": "string"},
+			"address_properties": addressPropertiesSchema,
+			"schema_version":     schemaVersionSchema,
+			"labels":             labelsSchema,
+			"updated_at":         bson.M{"bsonType": "date"},
+		},
+	},
+	PF_COLL: {
+		"bsonType": "object",
+		"required": bson.A{"pf_id"},
+		"properties": bson.M{
+			"pf_id": bson.M{"bsonType": "string"},
+			"pf_prop": bson.M{
+				"bsonType": "object",
+				"properties": bson.M{
+					"labels": labelsSchema,
+				},
+			},
+			"address_properties": addressPropertiesSchema,
+			"schema_version":     schemaVersionSchema,
+			"updated_at":         bson.M{"bsonType": "date"},
+		},
+	},
+	LEDGER_COLL: {
+		"bsonType": "object",
+		"required": bson.A{"namespaced_name", "address_id", "tag", "direction", "delta", "timestamp"},
+		"properties": bson.M{
+			"namespaced_name": bson.M{"bsonType": "string"},
+			"address_id":      bson.M{"bsonType": "string"},
+			"tag":             bson.M{"bsonType": "string"},
+			"direction":       bson.M{"enum": bson.A{DIRECTION_SENT, DIRECTION_RECV}},
+			"delta":           bson.M{"bsonType": "long"},
+			"timestamp":       bson.M{"bsonType": "date"},
+			"cost_micros":     bson.M{"bsonType": "long"},
+		},
+	},
+	LOST_COLL: {
+		"bsonType": "object",
+		"required": bson.A{"namespaced_name", "tag", "until", "reason"},
+		"properties": bson.M{
+			"namespaced_name": bson.M{"bsonType": "string"},
+			"tag":             bson.M{"bsonType": "string"},
+			"since":           bson.M{"bsonType": "date"},
+			"until":           bson.M{"bsonType": "date"},
+			"reason":          bson.M{"bsonType": "string"},
+		},
+	},
+	NS_USAGE_COLL: {
+		"bsonType": "object",
+		"required": bson.A{"usage_id", "namespace", "period"},
+		"properties": bson.M{
+			"usage_id":  bson.M{"bsonType": "string"},
+			"namespace": bson.M{"bsonType": "string"},
+			"period":    bson.M{"bsonType": "string"},
+			"tags": bson.M{
+				"bsonType": "object",
+				"additionalProperties": bson.M{
+					"bsonType": "object",
+					"properties": bson.M{
+						"sent_bytes": bson.M{"bsonType": "long"},
+						"recv_bytes": bson.M{"bsonType": "long"},
+						"cost_micros": bson.M{
+							"bsonType":             "object",
+							"additionalProperties": bson.M{"bsonType": "long"},
+						},
+					},
+				},
+			},
+			"schema_version": schemaVersionSchema,
+		},
+	},
+}
+
+// ensureIndexes creates the indexes of all collections if they don't exist yet. Creating
+// a unique index fails if the collection already has duplicated documents.
+func (s *Store) ensureIndexes(ctx context.Context) error {
+	for coll, models := range indexes {
+		createCtx, cancel := context.WithTimeout(ctx, time.Second*30)
+		_, err := s.conn.Collection(coll).Indexes().CreateMany(createCtx, models)
+		cancel()
+		if mongo.IsDuplicateKeyError(err) {
+			return s.explainDuplicates(ctx, coll, models, err)
+		}
+		if err != nil {
+			return err
+		}
+		s.Log.Info("the indexes have been ensured", "collection", coll)
+	}
+	return nil
+}
+
+// explainDuplicates logs the duplicated keys which keep the unique indexes of coll from
+// being created; they have to be merged or removed by hand before the store can launch.
+func (s *Store) explainDuplicates(ctx context.Context, coll string, models []mongo.IndexModel, indexErr error) error {
+	var dups []string
+	for _, m := range models {
+		keys, ok := m.Keys.(bson.D)
+		if m.Options == nil || m.Options.Unique == nil || !*m.Options.Unique || !ok || len(keys) != 1 {
+			continue
+		}
+		field := keys[0].Key
+		pipeline := mongo.Pipeline{
+			{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$" + field},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}}},
+			{{Key: "$match", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+			{{Key: "$limit", Value: 10}},
+		}
+		aggCtx, cancel := context.WithTimeout(ctx, time.Second*30)
+		cur, err := s.conn.Collection(coll).Aggregate(aggCtx, pipeline)
+		if err != nil {
+			cancel()
+			s.Log.Error(err, "unable to look up the duplicated keys", "collection", coll, "field", field)
+			continue
+		}
+		var groups []struct {
+			Key   interface{} `bson:"_id"`
+			Count int         `bson:"count"`
+		}
+		err = cur.All(aggCtx, &groups)
+		cancel()
+		if err != nil {
+			s.Log.Error(err, "unable to look up the duplicated keys", "collection", coll, "field", field)
+			continue
+		}
+		for _, g := range groups {
+			s.Log.Info("the key is duplicated", "collection", coll, "field", field, "key", g.Key, "count", g.Count)
+			dups = append(dups, fmt.Sprintf("%s=%v (%d documents)", field, g.Key, g.Count))
+		}
+	}
+	if len(dups) == 0 {
+		return indexErr
+	}
+	return fmt.Errorf("unable to create the unique indexes of %s since some keys are duplicated: %s: %v", coll, strings.Join(dups, ", "), indexErr)
+}
+
+// installValidators installs a JSON schema validator on every collection, creating the
+// collection if necessary. Existing documents which are invalid are left untouched.
+func (s *Store) installValidators(ctx context.Context) error {
+	for coll, schema := range validators {
+		validator := bson.M{"$jsonSchema": schema}
+		cmd := bson.D{
+			{Key: "collMod", Value: coll},
+			{Key: "validator", Value: validator},
+			{Key: "validationLevel", Value: "moderate"},
+		}
+		err := s.conn.RunCommand(ctx, cmd).Err()
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Code == namespaceNotFoundCode {
+			opts := options.CreateCollection().SetValidator(validator).SetValidationLevel("moderate")
+			err = s.conn.CreateCollection(ctx, coll, opts)
+		}
+		if err != nil {
+			return err
+		}
+		s.Log.Info("the validator has been installed", "collection", coll)
+	}
+	return nil
+}
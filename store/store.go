@@ -5,7 +5,11 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"net/http"
+	"net/netip"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -14,12 +18,30 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
 const (
-	SQID_ALPHABET = "abcdefghijklmnopqrstuvwxyz0123456789"
+	SQID_ALPHABET         = "abcdefghijklmnopqrstuvwxyz0123456789"
+	DEFAULT_MAX_POOL_SIZE = 20
+	DEFAULT_READ_TIMEOUT  = time.Second * 5
+	DEFAULT_WRITE_TIMEOUT = time.Second * 1
+	PTA_COLL              = "pod_traffic_accounts"
+	PF_COLL               = "port_feeds"
+	LEDGER_COLL           = "sync_ledger"
+	NS_USAGE_COLL         = "namespace_usages"
+	LOST_COLL             = "lost_accountings"
 )
 
+// documents created by upserts are written in the current schema
+var setOnInsertSchemaVersion = bson.E{
+	Key: "$setOnInsert",
+	Value: bson.D{{
+		Key:   "schema_version",
+		Value: CURRENT_SCHEMA_VERSION,
+	}},
+}
+
 type DBCred struct {
 	DBHost string
 	DBPort string
@@ -29,50 +51,148 @@ type DBCred struct {
 }
 
 type Store struct {
-	Cred     *DBCred
-	Log      *logr.Logger
-	db       *mongo.Database
+	Cred *DBCred
+	Log  *logr.Logger
+	// install JSON schema validators on the collections when launching
+	InstallValidators bool
+	// only report what the pending migrations would change instead of applying them
+	MigrationDryRun bool
+	// the size of the connection pool; DEFAULT_MAX_POOL_SIZE if zero
+	MaxPoolSize uint64
+	// prices the traffic rolled up into the usage of the namespaces; free if nil
+	Pricer Pricer
+	// the timeouts of the operations, which can be changed while the store is running
+	readTimeoutNs  atomic.Int64
+	writeTimeoutNs atomic.Int64
+	// the database is only published once the indexes, the validators and the migrations
+	// are in place, so that nothing is written into a collection without its indexes
+	db       atomic.Pointer[mongo.Database]
+	conn     *mongo.Database
 	dbClient *mongo.Client
+	// the error of the last launch; nil once the store is ready
+	mu        sync.Mutex
+	launchErr error
 }
 
+// Launch connects to the database and prepares it. It can be called again after it has
+// failed, e.g. by KeepLaunching; it does nothing once it has succeeded.
 func (s *Store) Launch(ctx context.Context) error {
+	err := s.launch(ctx)
+	s.mu.Lock()
+	s.launchErr = err
+	s.mu.Unlock()
+	return err
+}
+
+// Ready reports whether the store has been launched successfully. It can be used as a readiness check.
+func (s *Store) Ready(_ *http.Request) error {
+	if s.db.Load() != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.launchErr == nil {
+		return fmt.Errorf("the store has not been launched yet")
+	}
+	return s.launchErr
+}
+
+// SetTimeouts changes the timeouts of reads and writes. Zero keeps the default.
+func (s *Store) SetTimeouts(read time.Duration, write time.Duration) {
+	s.readTimeoutNs.Store(int64(read))
+	s.writeTimeoutNs.Store(int64(write))
+}
+
+func (s *Store) readTimeout() time.Duration {
+	if t := s.readTimeoutNs.Load(); t > 0 {
+		return time.Duration(t)
+	}
+	return DEFAULT_READ_TIMEOUT
+}
+
+func (s *Store) writeTimeout() time.Duration {
+	if t := s.writeTimeoutNs.Load(); t > 0 {
+		return time.Duration(t)
+	}
+	return DEFAULT_WRITE_TIMEOUT
+}
+
+func (s *Store) launch(ctx context.Context) (err error) {
 	if s.Cred == nil || s.Log == nil {
 		return fmt.Errorf("the credential and the logger shouldn't be nil")
 	}
+	if s.db.Load() != nil {
+		return nil
+	}
 	cred := s.Cred
-	uri := fmt.Sprintf("mongodb://%s:%s@%s:%s/?maxPoolSize=20&w=majority", cred.DBUser, cred.DBPass, cred.DBHost, cred.DBPort)
-	clientOps := options.Client().ApplyURI(uri)
+	maxPoolSize := s.MaxPoolSize
+	if maxPoolSize == 0 {
+		maxPoolSize = DEFAULT_MAX_POOL_SIZE
+	}
+	uri := fmt.Sprintf("mongodb://%s:%s@%s:%s/?maxPoolSize=%d&w=majority", cred.DBUser, cred.DBPass, cred.DBHost, cred.DBPort, maxPoolSize)
+	// the commands are traced as children of the spans of the callers
+	clientOps := options.Client().ApplyURI(uri).SetMonitor(otelmongo.NewMonitor())
 	if client, err := mongo.Connect(ctx, clientOps); err != nil {
 		return err
 	} else {
 		s.dbClient = client
 	}
+	defer func() {
+		if err != nil {
+			// the next launch connects again
+			s.dbClient.Disconnect(context.Background())
+			s.dbClient = nil
+		}
+	}()
 	if err := s.dbClient.Ping(ctx, readpref.Primary()); err != nil {
 		return err
 	} else {
-		s.db = s.dbClient.Database(cred.DB)
+		s.conn = s.dbClient.Database(cred.DB)
+	}
+	if err := s.requireTransactions(ctx); err != nil {
+		return err
+	}
+	if err := s.ensureIndexes(ctx); err != nil {
+		return fmt.Errorf("unable to create the indexes: %v", err)
 	}
+	if s.InstallValidators {
+		if err := s.installValidators(ctx); err != nil {
+			return fmt.Errorf("unable to install the validators: %v", err)
+		}
+	}
+	if err := s.migrate(ctx); err != nil {
+		return fmt.Errorf("unable to migrate the database: %v", err)
+	}
+	if s.MigrationDryRun {
+		return ErrMigrationDryRun
+	}
+	s.db.Store(s.conn)
 	return nil
 }
 func (s *Store) Close(ctx context.Context) {
-	s.dbClient.Disconnect(context.TODO())
+	if s.dbClient == nil {
+		return
+	}
+	if err := s.dbClient.Disconnect(ctx); err != nil && s.Log != nil {
+		s.Log.Error(err, "unable to disconnect from the database")
+	}
 }
 
 func (s *Store) FindPTA(ctx context.Context, nn string, pta *PodTrafficAccount) (bool, error) {
 	if pta == nil {
 		return false, fmt.Errorf("the pta cannot be nil")
 	}
-	if s.db == nil {
+	if s.db.Load() == nil {
 		return false, fmt.Errorf("please call Launch first")
 	}
-	coll := s.db.Collection("pod_traffic_accounts")
+	coll := s.db.Load().Collection(PTA_COLL)
 	filter := bson.D{
 		{
 			Key:   "namespaced_name",
 			Value: nn,
 		},
 	}
-	getCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+	getCtx, cancel := context.WithTimeout(ctx, s.readTimeout())
 	defer cancel()
 	if err := coll.FindOne(getCtx, filter).Decode(pta); err != nil {
 		if err != mongo.ErrNoDocuments {
@@ -88,17 +208,17 @@ func (s *Store) FindPF(ctx context.Context, pf_id string, pf *PortFeed) (bool, e
 	if pf == nil {
 		return false, fmt.Errorf("the pf cannot be nil")
 	}
-	if s.db == nil {
+	if s.db.Load() == nil {
 		return false, fmt.Errorf("please call Launch first")
 	}
-	coll := s.db.Collection("port_feeds")
+	coll := s.db.Load().Collection(PF_COLL)
 	filter := bson.D{
 		{
 			Key:   "pf_id",
 			Value: pf_id,
 		},
 	}
-	getCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+	getCtx, cancel := context.WithTimeout(ctx, s.readTimeout())
 	defer cancel()
 	if err := coll.FindOne(getCtx, filter).Decode(pf); err != nil {
 		if err != mongo.ErrNoDocuments {
@@ -115,11 +235,12 @@ func (s *Store) UpdateFieldUint64(ctx context.Context, req TagPropReq, op string
 	if log == nil {
 		return nil
 	}
-	if s.db == nil {
+	if s.db.Load() == nil {
 		return fmt.Errorf("please call Launch first")
 	}
-	coll := s.db.Collection("pod_traffic_accounts")
-	updateCtx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+	coll := s.db.Load().Collection(PTA_COLL)
+	// a write isn't cut short when the caller gives up, but it's still traced with the caller
+	updateCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.writeTimeout())
 	defer cancel()
 	opts := options.Update().SetUpsert(true)
 	filter := bson.D{{
@@ -131,68 +252,30 @@ func (s *Store) UpdateFieldUint64(ctx context.Context, req TagPropReq, op string
 		return err
 	}
 	key := fmt.Sprintf("address_properties.%s.tag_properties.%s.%s", id, req.Tag, field)
-	update := bson.D{{
-		Key: op,
-		Value: bson.D{{
-			Key:   key,
-			Value: value,
-		}},
-	}}
-	if _, err := coll.UpdateOne(updateCtx, filter, update, opts); err != nil {
-		return err
-	} else {
-		log.Info("the data has been updated", "field", key)
-	}
-	return nil
-}
-
-// TODO: set property in another function
-func (s *Store) UpdatePortFeedByAddr(ctx context.Context, req PortFeedProp, addr string, tag string, tp TagProperty) error {
-	log := s.Log
-	if log == nil {
-		return nil
-	}
-	if s.db == nil {
-		return fmt.Errorf("please call Launch first")
-	}
-	coll := s.db.Collection("port_feeds")
-	updateCtx, cancel := context.WithTimeout(context.Background(), time.Second*1)
-	defer cancel()
-	opts := options.Update().SetUpsert(true)
-	pf_id := fmt.Sprintf("%s/%s", req.Namespace, req.Pod)
-	filter := bson.D{{
-		Key:   "pf_id",
-		Value: pf_id,
-	}}
-	key := fmt.Sprintf("address_properties.%s.tag_properties.%s", addr, tag)
 	update := bson.D{
 		{
-			Key: "$set",
+			Key: op,
 			Value: bson.D{{
 				Key:   key,
-				Value: tp,
+				Value: value,
 			}},
 		},
-		{
-			Key: "$set",
-			Value: bson.D{{
-				Key:   "pf_prop",
-				Value: req,
-			}},
-		}}
+		setOnInsertSchemaVersion,
+	}
 	if _, err := coll.UpdateOne(updateCtx, filter, update, opts); err != nil {
 		return err
 	} else {
-		log.Info("the data of the port feed has been updated", "addr", addr, "tag", tag)
+		log.Info("the data has been updated", "field", key)
 	}
 	return nil
 }
+
 func (s *Store) Save(ctx context.Context, key string, pta *PodTrafficAccount) error {
-	if s.db == nil {
+	if s.db.Load() == nil {
 		return fmt.Errorf("please call Launch first")
 	}
-	coll := s.db.Collection("pod_traffic_accounts")
-	putCtx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+	coll := s.db.Load().Collection(PTA_COLL)
+	putCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.writeTimeout())
 	defer cancel()
 	opts := options.Replace().SetUpsert(true)
 	filter := bson.D{{
@@ -200,18 +283,38 @@ func (s *Store) Save(ctx context.Context, key string, pta *PodTrafficAccount) er
 		Value: key,
 	}}
 	replacement := pta
+	replacement.SchemaVersion = CURRENT_SCHEMA_VERSION
+	replacement.UpdatedAt = time.Now()
 	if _, err := coll.ReplaceOne(putCtx, filter, replacement, opts); err != nil {
 		return err
 	}
 	return nil
 }
 
+// NormalizeIP returns the canonical form of an address: IPv4-mapped IPv6 addresses become
+// IPv4 ones and IPv6 ones are compressed in lower case, so that every address has exactly
+// one form. Addresses with a zone are rejected, since the zone is local to a node.
+func NormalizeIP(addr string) (string, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return "", fmt.Errorf("this is not a valid ip address: %v", err)
+	}
+	if ip.Zone() != "" {
+		return "", fmt.Errorf("the ip address %s shouldn't have a zone", addr)
+	}
+	return ip.Unmap().String(), nil
+}
+
 func encodeIP(_ipAddr string, id *string) error {
 	if id == nil {
 		return fmt.Errorf("id shouldn't be nil")
 	}
 	var numbers []uint64
-	_ip := net.ParseIP(_ipAddr)
+	normalized, err := NormalizeIP(_ipAddr)
+	if err != nil {
+		return err
+	}
+	_ip := net.ParseIP(normalized)
 	if _ip == nil {
 		return fmt.Errorf("this is not a valid ip address")
 	}
@@ -0,0 +1,60 @@
+package store
+
+import "testing"
+
+func TestNormalizeIP(t *testing.T) {
+	cases := []struct {
+		addr       string
+		normalized string
+		fails      bool
+	}{
+		{addr: "10.0.0.1", normalized: "10.0.0.1"},
+		{addr: "::ffff:10.0.0.1", normalized: "10.0.0.1"},
+		{addr: "2001:DB8:0:0:0:0:0:1", normalized: "2001:db8::1"},
+		{addr: "2001:db8::1", normalized: "2001:db8::1"},
+		{addr: "fe80::1%eth0", fails: true},
+		{addr: "10.0.0.256", fails: true},
+		{addr: "", fails: true},
+	}
+	for _, c := range cases {
+		normalized, err := NormalizeIP(c.addr)
+		if (err != nil) != c.fails {
+			t.Errorf("NormalizeIP(%q) failed with %v; want it to fail: %v", c.addr, err, c.fails)
+			continue
+		}
+		if normalized != c.normalized {
+			t.Errorf("NormalizeIP(%q) = %q; want %q", c.addr, normalized, c.normalized)
+		}
+	}
+}
+
+// The forms of an address share the key the documents are stored under.
+func TestEncodeIPOfEquivalentForms(t *testing.T) {
+	for _, forms := range [][]string{
+		{"10.0.0.1", "::ffff:10.0.0.1"},
+		{"2001:db8::1", "2001:DB8:0:0:0:0:0:1", "2001:0db8::0001"},
+	} {
+		var want string
+		if err := encodeIP(forms[0], &want); err != nil {
+			t.Fatalf("unable to encode %s: %v", forms[0], err)
+		}
+		for _, form := range forms[1:] {
+			var id string
+			if err := encodeIP(form, &id); err != nil {
+				t.Errorf("unable to encode %s: %v", form, err)
+			} else if id != want {
+				t.Errorf("%s is encoded as %s but %s as %s", form, id, forms[0], want)
+			}
+		}
+	}
+	var v4, v6 string
+	if err := encodeIP("0.0.0.1", &v4); err != nil {
+		t.Fatal(err)
+	}
+	if err := encodeIP("::1", &v6); err != nil {
+		t.Fatal(err)
+	}
+	if v4 == v6 {
+		t.Errorf("0.0.0.1 and ::1 are both encoded as %s", v4)
+	}
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the usage of the namespaces is rolled up per calendar month in UTC
+const USAGE_PERIOD_LAYOUT = "2006-01"
+
+// Pricer prices the traffic of the namespaces as it's accounted.
+type Pricer interface {
+	// Price returns the cost in micro units of the currency of delta bytes of the tag in
+	// the direction, given that the namespace has had periodBytes of them in the period
+	// already. The cost is the marginal one, so tiers and free allowances apply to the
+	// traffic of the whole period, and the bytes accounted before the pricing changes keep
+	// the prices they were accounted with.
+	Price(tag string, direction string, periodBytes uint64, delta uint64) (costMicros int64, currency string)
+}
+
+type TagUsage struct {
+	SentBytes uint64 `bson:"sent_bytes"`
+	RecvBytes uint64 `bson:"recv_bytes"`
+	// the cost in micro units by currency, as the currency of the pricing may change
+	// within a period
+	CostMicros map[string]int64 `bson:"cost_micros"`
+}
+
+// NamespaceUsage rolls up the traffic of all pods of a namespace and its cost within a period.
+type NamespaceUsage struct {
+	ID            string              `bson:"usage_id"` // pk
+	Namespace     string              `bson:"namespace"`
+	Period        string              `bson:"period"`
+	Tags          map[string]TagUsage `bson:"tags"`
+	SchemaVersion int                 `bson:"schema_version"`
+}
+
+// UsagePeriodOf returns the period t belongs to.
+func UsagePeriodOf(t time.Time) string {
+	return t.UTC().Format(USAGE_PERIOD_LAYOUT)
+}
+
+func usageID(namespace string, period string) string {
+	return fmt.Sprintf("%s/%s", namespace, period)
+}
+
+func (u *NamespaceUsage) bytesOf(tag string, direction string) uint64 {
+	tu := u.Tags[tag]
+	if direction == DIRECTION_RECV {
+		return tu.RecvBytes
+	}
+	return tu.SentBytes
+}
+
+// accrue prices the delta of the entry on top of the usage of its namespace and adds
+// both to the usage.
+func (u *NamespaceUsage) accrue(p Pricer, entry *LedgerEntry) {
+	if u.Tags == nil {
+		u.Tags = make(map[string]TagUsage)
+	}
+	if p != nil {
+		entry.CostMicros, entry.Currency = p.Price(entry.Tag, entry.Direction, u.bytesOf(entry.Tag, entry.Direction), entry.Delta)
+	}
+	tu := u.Tags[entry.Tag]
+	switch entry.Direction {
+	case DIRECTION_SENT:
+		tu.SentBytes += entry.Delta
+	case DIRECTION_RECV:
+		tu.RecvBytes += entry.Delta
+	}
+	if entry.Currency != "" {
+		if tu.CostMicros == nil {
+			tu.CostMicros = make(map[string]int64)
+		}
+		tu.CostMicros[entry.Currency] += entry.CostMicros
+	}
+	u.Tags[entry.Tag] = tu
+}
+
+// accrueUsage rolls the entry up into the usage of its namespace within the transaction
+// of ApplyDelta, so that concurrent deltas of the namespace are priced one after another.
+func (s *Store) accrueUsage(sc mongo.SessionContext, entry *LedgerEntry) error {
+	var namespace, pod string
+	if err := splitNamespacedName(entry.NamespacedName, &namespace, &pod); err != nil {
+		return err
+	}
+	period := UsagePeriodOf(entry.Timestamp)
+	id := usageID(namespace, period)
+	coll := s.db.Load().Collection(NS_USAGE_COLL)
+	filter := bson.D{{Key: "usage_id", Value: id}}
+	var usage NamespaceUsage
+	if err := coll.FindOne(sc, filter).Decode(&usage); err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	bytesField, _, err := fieldsOfDirection(entry.Direction)
+	if err != nil {
+		return err
+	}
+	usage.accrue(s.Pricer, entry)
+	prefix := "tags." + entry.Tag
+	inc := bson.D{{Key: prefix + "." + bytesField, Value: entry.Delta}}
+	if entry.Currency != "" {
+		inc = append(inc, bson.E{Key: prefix + ".cost_micros." + entry.Currency, Value: entry.CostMicros})
+	}
+	update := bson.D{
+		{Key: "$inc", Value: inc},
+		{Key: "$set", Value: bson.D{
+			{Key: "namespace", Value: namespace},
+			{Key: "period", Value: period},
+		}},
+		setOnInsertSchemaVersion,
+	}
+	_, err = coll.UpdateOne(sc, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s *Store) FindNamespaceUsage(ctx context.Context, namespace string, period string, usage *NamespaceUsage) (bool, error) {
+	if usage == nil {
+		return false, fmt.Errorf("the usage cannot be nil")
+	}
+	if s.db.Load() == nil {
+		return false, fmt.Errorf("please call Launch first")
+	}
+	coll := s.db.Load().Collection(NS_USAGE_COLL)
+	filter := bson.D{{Key: "usage_id", Value: usageID(namespace, period)}}
+	getCtx, cancel := context.WithTimeout(ctx, s.readTimeout())
+	defer cancel()
+	if err := coll.FindOne(getCtx, filter).Decode(usage); err != nil {
+		if err != mongo.ErrNoDocuments {
+			return false, err
+		} else {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (s *BoltStore) accrueUsage(tx *bolt.Tx, entry *LedgerEntry) error {
+	var namespace, pod string
+	if err := splitNamespacedName(entry.NamespacedName, &namespace, &pod); err != nil {
+		return err
+	}
+	period := UsagePeriodOf(entry.Timestamp)
+	id := usageID(namespace, period)
+	var usage NamespaceUsage
+	if found, err := getDoc(tx, NS_USAGE_COLL, id, &usage); err != nil {
+		return err
+	} else if !found {
+		usage = NamespaceUsage{
+			ID:            id,
+			Namespace:     namespace,
+			Period:        period,
+			SchemaVersion: CURRENT_SCHEMA_VERSION,
+		}
+	}
+	usage.accrue(s.Pricer, entry)
+	return putDoc(tx, NS_USAGE_COLL, id, &usage)
+}
+
+func (s *BoltStore) FindNamespaceUsage(ctx context.Context, namespace string, period string, usage *NamespaceUsage) (bool, error) {
+	if usage == nil {
+		return false, fmt.Errorf("the usage cannot be nil")
+	}
+	if s.db.Load() == nil {
+		return false, fmt.Errorf("please call Launch first")
+	}
+	var found bool
+	err := s.db.Load().View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = getDoc(tx, NS_USAGE_COLL, usageID(namespace, period), usage)
+		return err
+	})
+	return found, err
+}
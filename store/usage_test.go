@@ -0,0 +1,54 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// flatPricer charges a micro unit per byte in its currency.
+type flatPricer struct {
+	currency string
+}
+
+func (p *flatPricer) Price(tag string, direction string, periodBytes uint64, delta uint64) (int64, string) {
+	return int64(delta), p.currency
+}
+
+// The cost accrued before the currency of the pricing changes within a period is kept
+// apart from the cost accrued after.
+func TestBoltUsageKeepsCostsByCurrency(t *testing.T) {
+	ctx := context.Background()
+	s := newBoltStore(t)
+	pricer := &flatPricer{currency: "CNY"}
+	s.Pricer = pricer
+	req := TagPropReq{NamespacedName: "default/web-0", Addr: "10.0.0.1", Tag: "public"}
+	entries := []struct {
+		currency string
+		entry    LedgerEntry
+	}{
+		{"CNY", LedgerEntry{Direction: DIRECTION_SENT, NewMark: 100, Delta: 100}},
+		{"CNY", LedgerEntry{Direction: DIRECTION_RECV, NewMark: 50, Delta: 50}},
+		{"USD", LedgerEntry{Direction: DIRECTION_SENT, StoredMark: 100, OldMark: 100, NewMark: 130, Delta: 30}},
+		// the traffic matched by no rule isn't priced
+		{"", LedgerEntry{Direction: DIRECTION_SENT, StoredMark: 130, OldMark: 130, NewMark: 140, Delta: 10}},
+	}
+	timestamp := time.Date(2024, time.March, 10, 0, 0, 0, 0, time.UTC)
+	for i, e := range entries {
+		pricer.currency = e.currency
+		e.entry.Timestamp = timestamp.Add(time.Duration(i) * time.Hour)
+		if err := s.ApplyDelta(ctx, req, e.entry); err != nil {
+			t.Fatalf("unable to apply entry %d: %v", i, err)
+		}
+	}
+
+	var usage NamespaceUsage
+	if found, err := s.FindNamespaceUsage(ctx, "default", "2024-03", &usage); err != nil || !found {
+		t.Fatalf("unable to find the usage: %v", err)
+	}
+	want := TagUsage{SentBytes: 140, RecvBytes: 50, CostMicros: map[string]int64{"CNY": 150, "USD": 30}}
+	if got := usage.Tags["public"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("the usage has %+v; want %+v", got, want)
+	}
+}
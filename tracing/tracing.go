@@ -0,0 +1,82 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/dinoallo/sealos-networkmanager-synchronizer/settings"
+)
+
+const TRACER_NAME = "github.com/dinoallo/sealos-networkmanager-synchronizer"
+
+// Tracer returns the tracer of the synchronizer. The spans are dropped unless Setup has
+// installed an exporter.
+func Tracer() trace.Tracer {
+	return otel.Tracer(TRACER_NAME)
+}
+
+// Setup installs the global tracer provider exporting to the OTLP collector of the config.
+// The returned function flushes the pending spans and should be called before exiting.
+func Setup(ctx context.Context, cfg settings.TracingConfig) (func(context.Context) error, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	// the exporter connects lazily, so an unavailable collector doesn't block the start
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+	sampler, err := newSampler(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sampler),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+func newSampler(cfg settings.TracingConfig) (sdktrace.Sampler, error) {
+	switch cfg.Sampler {
+	case settings.SAMPLER_ALWAYS_ON:
+		return sdktrace.AlwaysSample(), nil
+	case settings.SAMPLER_ALWAYS_OFF:
+		return sdktrace.NeverSample(), nil
+	case settings.SAMPLER_RATIO:
+		return sdktrace.TraceIDRatioBased(cfg.SamplerRatio), nil
+	case settings.SAMPLER_PARENT_BASED_RATIO:
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SamplerRatio)), nil
+	default:
+		return nil, fmt.Errorf("unknown sampler %s", cfg.Sampler)
+	}
+}
+
+// End ends the span, marking it as failed if err isn't nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}